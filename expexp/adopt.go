@@ -0,0 +1,68 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync/atomic"
+)
+
+// Adopt takes over the runtime state of old, the configuration cfg replaces
+// on a reload: the readiness gate, so an instance that became ready stays
+// ready, and the scrape state, error history, caches, rate limits and last
+// results of the modules whose configuration did not change. The commands
+// of unchanged stream modules keep running, owned by cfg. It must be called
+// before NewHandler and Run for cfg.
+func (cfg *Config) Adopt(old *Config) {
+	if old.ready != nil {
+		cfg.ready = &readiness{
+			cfg:   cfg,
+			start: old.ready.start,
+			ready: atomic.LoadInt32(&old.ready.ready),
+		}
+	}
+	for name, m := range cfg.Modules {
+		om, ok := old.Modules[name]
+		if !ok || !sameModuleConfig(m, om) {
+			continue
+		}
+		m.state = om.state
+		m.cache = om.cache
+		m.limiter = om.limiter
+		m.monotonic = om.monotonic
+		m.File.rotation = om.File.rotation
+		if m.Method == "stream" {
+			m.Stream.snapshot = om.Stream.snapshot
+			m.Stream.proc = om.Stream.proc
+			m.Stream.proc.adopt(cfg)
+		}
+	}
+}
+
+// sameModuleConfig reports whether a and b are configured the same. Only the
+// settings are compared, not the runtime state. Secrets left out of the JSON
+// encoding are not compared either, none of the adopted state depends on
+// them.
+func sameModuleConfig(a, b *ModuleConfig) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ja, jb)
+}
@@ -0,0 +1,151 @@
+package expexp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdoptKeepsReadinessAndState(t *testing.T) {
+	withFakeClock(t)
+	load := func(timeout time.Duration) *Config {
+		cfg := &Config{Modules: map[string]*ModuleConfig{
+			"same":    {Method: "sentinel"},
+			"changed": {Method: "sentinel", Timeout: timeout},
+		}}
+		cfg.Global.ReadyRequires = []string{"same"}
+		for name, m := range cfg.Modules {
+			if err := CheckModuleConfig(name, m); err != nil {
+				t.Fatalf("Failed to check module config: %v", err)
+			}
+		}
+		if err := cfg.Check(); err != nil {
+			t.Fatalf("Failed to check config: %v", err)
+		}
+		return cfg
+	}
+	get := func(h http.Handler, path string) int {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr.Code
+	}
+
+	old := load(time.Second)
+	h := NewHandler(old, "/proxy")
+	get(h, "/proxy?module=same")
+	if got := get(h, "/-/ready"); got != http.StatusOK {
+		t.Fatalf("expected to be ready after scraping the required module, got %v", got)
+	}
+
+	cfg := load(2 * time.Second)
+	cfg.Adopt(old)
+	h = NewHandler(cfg, "/proxy")
+	if got := get(h, "/-/ready"); got != http.StatusOK {
+		t.Errorf("expected to stay ready over the reload, got %v", got)
+	}
+	if cfg.Modules["same"].state != old.Modules["same"].state {
+		t.Errorf("expected the unchanged module to keep its state")
+	}
+	if cfg.Modules["changed"].state == old.Modules["changed"].state {
+		t.Errorf("expected the changed module to get a fresh state")
+	}
+}
+
+func TestAdoptKeepsStreamCommand(t *testing.T) {
+	load := func() *Config {
+		cfg := &Config{Modules: map[string]*ModuleConfig{
+			"stream": {Method: "stream", Stream: StreamConfig{Command: "sleep", Args: []string{"60"}}},
+		}}
+		for name, m := range cfg.Modules {
+			if err := CheckModuleConfig(name, m); err != nil {
+				t.Fatalf("Failed to check module config: %v", err)
+			}
+		}
+		if err := cfg.Check(); err != nil {
+			t.Fatalf("Failed to check config: %v", err)
+		}
+		return cfg
+	}
+	run := func(cfg *Config) (context.CancelFunc, chan struct{}) {
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			cfg.Run(ctx)
+		}()
+		return cancel, stopped
+	}
+	running := func(p *streamProc) bool {
+		p.Lock()
+		defer p.Unlock()
+		if p.done == nil {
+			return false
+		}
+		select {
+		case <-p.done:
+			return false
+		default:
+			return true
+		}
+	}
+
+	old := load()
+	cancel, stopped := run(old)
+	proc := old.Modules["stream"].Stream.proc
+	for deadline := time.Now().Add(5 * time.Second); !running(proc); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream command did not start")
+		}
+	}
+
+	cfg := load()
+	cfg.Adopt(old)
+	if cfg.Modules["stream"].Stream.snapshot != old.Modules["stream"].Stream.snapshot {
+		t.Errorf("expected the unchanged stream module to keep its snapshot")
+	}
+	cancel()
+	<-stopped
+	if !running(proc) {
+		t.Fatalf("expected the adopted stream command to keep running")
+	}
+
+	cancel, stopped = run(cfg)
+	cancel()
+	<-stopped
+	if running(proc) {
+		t.Errorf("expected the stream command to stop with the Run of its new owner")
+	}
+}
+
+func TestReloadFailedClearsReadiness(t *testing.T) {
+	load := func() *Config {
+		cfg := &Config{Modules: map[string]*ModuleConfig{}}
+		if err := cfg.Check(); err != nil {
+			t.Fatalf("Failed to check config: %v", err)
+		}
+		return cfg
+	}
+	ready := func(cfg *Config) int {
+		rr := httptest.NewRecorder()
+		NewHandler(cfg, "/proxy").ServeHTTP(rr, httptest.NewRequest("GET", "/-/ready", nil))
+		return rr.Code
+	}
+
+	old := load()
+	if got := ready(old); got != http.StatusOK {
+		t.Fatalf("expected to be ready, got %v", got)
+	}
+	old.ReloadFailed(errors.New("broken config"))
+	if got := ready(old); got != http.StatusServiceUnavailable {
+		t.Errorf("expected not to be ready after a failed reload, got %v", got)
+	}
+
+	cfg := load()
+	cfg.Adopt(old)
+	if got := ready(cfg); got != http.StatusOK {
+		t.Errorf("expected to be ready again after a successful reload, got %v", got)
+	}
+}
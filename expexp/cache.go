@@ -0,0 +1,480 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	cacheResponsesCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_cache_responses_total",
+			Help: "Counts of responses of cached modules by cache state: fresh, stale or miss",
+		},
+		[]string{"module", "cache"},
+	)
+	cacheRefreshesCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_cache_refreshes_total",
+			Help: "Counts of background refreshes of stale cache entries by result: success, error or backoff for skipped ones",
+		},
+		[]string{"module", "result"},
+	)
+	cacheEntries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "expexp_cache_entries",
+			Help: "Number of responses held in the cache of a module",
+		},
+		[]string{"module"},
+	)
+	cacheRefreshBackoffs = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "expexp_cache_refresh_backoffs",
+			Help: "Number of cache entries whose background refresh is backing off after failures",
+		},
+		[]string{"module"},
+	)
+	minIntervalAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "expexp_module_served_age_seconds",
+			Help: "Age of the latest response of a module with min_interval, 0 if it was just obtained",
+		},
+		[]string{"module"},
+	)
+	bufferOverflowsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_buffer_overflows_total",
+			Help: "Counts of buffered module responses replaced with an error for exceeding buffer_max_bytes",
+		},
+		[]string{"module"},
+	)
+	cacheEvictionsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_cache_evictions_total",
+			Help: "Counts of cache entries evicted as expired or to stay within cache_max_entries",
+		},
+		[]string{"module"},
+	)
+)
+
+// defaultCacheMaxEntries bounds the number of cached responses of a module
+// unless cache_max_entries is set.
+const defaultCacheMaxEntries = 1000
+
+// defaultFailureBackoffMax caps the delay between failed background
+// refreshes unless failure_backoff_max is set.
+const defaultFailureBackoffMax = 5 * time.Minute
+
+// defaultBufferMaxBytes bounds the buffered responses of modules with
+// buffer_response unless buffer_max_bytes is set.
+const defaultBufferMaxBytes = 16 << 20
+
+var errResponseTooLarge = errors.New("module response exceeds buffer_max_bytes")
+
+// bufferedResponse is an http.ResponseWriter keeping the whole response in
+// memory. With max set, a body growing beyond max bytes is replaced with an
+// error response and any further writes fail.
+type bufferedResponse struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+
+	max      int64
+	overflow bool
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{status: http.StatusOK, header: http.Header{}}
+}
+
+func (b *bufferedResponse) Header() http.Header    { return b.header }
+func (b *bufferedResponse) WriteHeader(status int) { b.status = status }
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.overflow {
+		return 0, errResponseTooLarge
+	}
+	if b.max > 0 && int64(b.body.Len()+len(p)) > b.max {
+		b.overflow = true
+		b.status = http.StatusInternalServerError
+		b.header = http.Header{}
+		b.header.Set("Content-Type", "text/plain; charset=utf-8")
+		b.header.Set("X-Content-Type-Options", "nosniff")
+		b.body.Reset()
+		b.body.WriteString(errResponseTooLarge.Error() + "\n")
+		return 0, errResponseTooLarge
+	}
+	return b.body.Write(p)
+}
+
+// writeTo sends the buffered response to w.
+func (b *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for k, vs := range b.header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
+
+type cacheEntry struct {
+	key  string
+	resp *bufferedResponse
+	when time.Time
+}
+
+// refreshFailure tracks the consecutive failed refreshes of a cache entry.
+type refreshFailure struct {
+	count   int
+	retryAt time.Time
+}
+
+// responseCache keeps the successful responses of a module, keyed by the
+// request parameters and the negotiated encoding. It holds at most
+// maxEntries entries, evicting the least recently used ones, and drops
+// entries older than maxAge, when storing and every maxAge while the
+// configuration runs.
+//
+// With backoff set, failed background refreshes of an entry are not retried
+// before the backoff delay has passed. With keepErrors set, failed
+// responses are kept too.
+type responseCache struct {
+	sync.Mutex
+	name       string
+	maxEntries int
+	maxAge     time.Duration
+	backoff    backoff
+	keepErrors bool
+	lastSweep  time.Time
+	lru        *list.List
+	entries    map[string]*list.Element
+	refreshing map[string]bool
+	failures   map[string]*refreshFailure
+}
+
+func newResponseCache(name string, maxEntries int, maxAge time.Duration) *responseCache {
+	return &responseCache{
+		name:       name,
+		maxEntries: maxEntries,
+		maxAge:     maxAge,
+		lastSweep:  clk.Now(),
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+		refreshing: map[string]bool{},
+		failures:   map[string]*refreshFailure{},
+	}
+}
+
+func cacheKey(r *http.Request) string {
+	return r.URL.RawQuery + "\x00" + r.Header.Get("Accept") + "\x00" + r.Header.Get("Accept-Encoding")
+}
+
+func (c *responseCache) get(key string) *cacheEntry {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+func (c *responseCache) store(key string, resp *bufferedResponse) {
+	if resp.status != http.StatusOK && !c.keepErrors {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	now := clk.Now()
+	e := &cacheEntry{key: key, resp: resp, when: now}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+	} else {
+		c.entries[key] = c.lru.PushFront(e)
+	}
+	// A fresh response ends any backoff of the refreshes.
+	if _, ok := c.failures[key]; ok {
+		delete(c.failures, key)
+		c.countBackoffs(now)
+	}
+
+	// Entries nobody asks for any more are dropped here and by expire,
+	// looking for them at most once per maxAge.
+	if now.Sub(c.lastSweep) >= c.maxAge {
+		c.sweep(now)
+	}
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+	cacheEntries.WithLabelValues(c.name).Set(float64(c.lru.Len()))
+}
+
+// expire drops the entries older than maxAge, so an idle module does not
+// hold on to them.
+func (c *responseCache) expire() {
+	c.Lock()
+	defer c.Unlock()
+	c.sweep(clk.Now())
+	cacheEntries.WithLabelValues(c.name).Set(float64(c.lru.Len()))
+}
+
+// sweep drops the entries older than maxAge at now. c must be locked.
+func (c *responseCache) sweep(now time.Time) {
+	c.lastSweep = now
+	for el := c.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if now.Sub(el.Value.(*cacheEntry).when) > c.maxAge {
+			c.remove(el)
+		}
+		el = prev
+	}
+}
+
+// expireEvery calls expire every d until ctx is done.
+func expireEvery(ctx context.Context, d time.Duration, expire func()) {
+	for {
+		tctx, cancel := clk.WithTimeout(ctx, d)
+		<-tctx.Done()
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		expire()
+	}
+}
+
+// remove evicts the entry of el. Refreshes running for it are unaffected,
+// they store a new entry when done.
+func (c *responseCache) remove(el *list.Element) {
+	key := el.Value.(*cacheEntry).key
+	c.lru.Remove(el)
+	delete(c.entries, key)
+	if _, ok := c.failures[key]; ok {
+		delete(c.failures, key)
+		c.countBackoffs(clk.Now())
+	}
+	cacheEvictionsCount.WithLabelValues(c.name).Inc()
+}
+
+// startRefresh marks key as being refreshed, returning false if a refresh
+// is already running.
+func (c *responseCache) startRefresh(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.refreshing[key] {
+		return false
+	}
+	c.refreshing[key] = true
+	return true
+}
+
+func (c *responseCache) endRefresh(key string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.refreshing, key)
+}
+
+// backingOff reports whether refreshes of key are held back after failures.
+func (c *responseCache) backingOff(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	now := clk.Now()
+	c.countBackoffs(now)
+	f, ok := c.failures[key]
+	return ok && now.Before(f.retryAt)
+}
+
+// countBackoffs sets expexp_cache_refresh_backoffs to the number of keys
+// backing off at now. Failures whose backoff ended more than the maximum
+// delay ago are forgotten, the next failure of such a key starts over with
+// the initial delay. c must be locked.
+func (c *responseCache) countBackoffs(now time.Time) {
+	n := 0
+	for key, f := range c.failures {
+		switch {
+		case now.Before(f.retryAt):
+			n++
+		case now.Sub(f.retryAt) > c.backoff.max:
+			delete(c.failures, key)
+		}
+	}
+	cacheRefreshBackoffs.WithLabelValues(c.name).Set(float64(n))
+}
+
+// refreshFailed records a failed refresh of key, delaying the next one if
+// backoff is configured.
+func (c *responseCache) refreshFailed(key string) {
+	if c.backoff.initial == 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	now := clk.Now()
+	c.countBackoffs(now)
+	f, ok := c.failures[key]
+	if !ok {
+		f = &refreshFailure{}
+		c.failures[key] = f
+	}
+	d := c.backoff.delay(f.count)
+	f.count++
+	f.retryAt = now.Add(d)
+	log.Debugf("Refresh of module %v failed %v times, next one in %v", c.name, f.count, d)
+	c.countBackoffs(now)
+}
+
+// serveCached answers r from the cache of m when possible. Entries younger
+// than CacheTTL are served as they are. Entries that are at most
+// StaleWhileRevalidate older than that are served as well, while the module
+// is run in the background to refresh them, unless refreshes of the entry
+// are backing off after failures. Anything else runs the module
+// synchronously, unless that failed recently and is backing off as well.
+// Then the expired entry is served if there still is one, or 503.
+func (m ModuleConfig) serveCached(w http.ResponseWriter, r *http.Request) {
+	key := cacheKey(r)
+	e := m.cache.get(key)
+	if e != nil {
+		age := clk.Now().Sub(e.when)
+		switch {
+		case age <= m.CacheTTL:
+			cacheResponsesCount.WithLabelValues(m.name, "fresh").Inc()
+			w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+			e.resp.writeTo(w)
+			return
+		case age <= m.CacheTTL+m.StaleWhileRevalidate:
+			cacheResponsesCount.WithLabelValues(m.name, "stale").Inc()
+			if m.cache.backingOff(key) {
+				cacheRefreshesCount.WithLabelValues(m.name, "backoff").Inc()
+				w.Header().Set("Warning", `111 - "Revalidation Failed"`)
+			} else if m.cache.startRefresh(key) {
+				go m.refresh(key, r.Clone(context.Background()))
+			}
+			w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+			e.resp.writeTo(w)
+			return
+		}
+	}
+
+	if m.cache.backingOff(key) {
+		cacheRefreshesCount.WithLabelValues(m.name, "backoff").Inc()
+		if e != nil {
+			cacheResponsesCount.WithLabelValues(m.name, "stale").Inc()
+			w.Header().Set("Warning", `111 - "Revalidation Failed"`)
+			w.Header().Set("Age", strconv.Itoa(int(clk.Now().Sub(e.when).Seconds())))
+			e.resp.writeTo(w)
+			return
+		}
+		cacheResponsesCount.WithLabelValues(m.name, "miss").Inc()
+		http.Error(w, fmt.Sprintf("Module %v failed recently, backing off", m.name), http.StatusServiceUnavailable)
+		return
+	}
+
+	cacheResponsesCount.WithLabelValues(m.name, "miss").Inc()
+	resp := m.serveBuffered(r)
+	if resp.status != http.StatusOK {
+		m.cache.refreshFailed(key)
+	}
+	m.cache.store(key, resp)
+	resp.writeTo(w)
+}
+
+// serveThrottled answers r with the previous response of m to the same
+// request while it is younger than MinInterval, so the source of m is not
+// hit more often than that. Unlike with serveCached failed responses are
+// repeated as well.
+func (m ModuleConfig) serveThrottled(w http.ResponseWriter, r *http.Request) {
+	key := cacheKey(r)
+	if e := m.cache.get(key); e != nil {
+		if age := clk.Now().Sub(e.when); age < m.MinInterval {
+			cacheResponsesCount.WithLabelValues(m.name, "fresh").Inc()
+			minIntervalAge.WithLabelValues(m.name).Set(age.Seconds())
+			w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+			e.resp.writeTo(w)
+			return
+		}
+	}
+
+	cacheResponsesCount.WithLabelValues(m.name, "miss").Inc()
+	minIntervalAge.WithLabelValues(m.name).Set(0)
+	resp := m.serveBuffered(r)
+	m.cache.store(key, resp)
+	resp.writeTo(w)
+}
+
+// serveBuffered runs the module for r, holding the whole response in memory
+// before anything is sent to the client. Responses larger than
+// BufferMaxBytes, when set, are replaced with an error.
+func (m ModuleConfig) serveBuffered(r *http.Request) (resp *bufferedResponse) {
+	resp = newBufferedResponse()
+	resp.max = m.BufferMaxBytes
+	defer func() {
+		// Failing writes make the module abort the response, there is
+		// nothing to abort as long as it is only buffered.
+		if p := recover(); p != nil && (p != http.ErrAbortHandler || !resp.overflow) {
+			panic(p)
+		}
+		if resp.overflow {
+			log.Warnf("Module %v response exceeded buffer_max_bytes %v", m.name, m.BufferMaxBytes)
+			bufferOverflowsCount.WithLabelValues(m.name).Inc()
+		}
+	}()
+	m.serve(resp, r)
+	return resp
+}
+
+// refresh runs the module for a stale cache entry. r must not be bound to the
+// lifetime of the client request that triggered the refresh.
+func (m ModuleConfig) refresh(key string, r *http.Request) {
+	defer m.cache.endRefresh(key)
+	defer func() {
+		// Aborted responses and panics are failed refreshes, there is no
+		// connection to abort here and nothing above this goroutine to
+		// recover them.
+		p := recover()
+		if p == nil {
+			return
+		}
+		if p == http.ErrAbortHandler {
+			log.Warnf("Background refresh of module %v was aborted", m.name)
+		} else {
+			log.Errorf("Module %v panicked during a background refresh, %v\n%s", m.name, p, debug.Stack())
+			modulePanicsCount.WithLabelValues(m.name).Inc()
+		}
+		cacheRefreshesCount.WithLabelValues(m.name, "error").Inc()
+		m.cache.refreshFailed(key)
+	}()
+	resp := m.serveBuffered(r)
+	if resp.status != http.StatusOK {
+		log.Warnf("Background refresh of module %v failed with status %v", m.name, resp.status)
+		cacheRefreshesCount.WithLabelValues(m.name, "error").Inc()
+		m.cache.refreshFailed(key)
+		return
+	}
+	cacheRefreshesCount.WithLabelValues(m.name, "success").Inc()
+	m.cache.store(key, resp)
+}
@@ -0,0 +1,266 @@
+package expexp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResponseCacheEviction(t *testing.T) {
+	fc := withFakeClock(t)
+	name := "cache_eviction"
+	c := newResponseCache(name, 2, time.Minute)
+	ok := func() *bufferedResponse { return newBufferedResponse() }
+
+	c.store("a", ok())
+	c.store("b", ok())
+	c.get("a")
+	c.store("c", ok())
+	if c.get("b") != nil {
+		t.Errorf("expected the least recently used entry to be evicted")
+	}
+	if c.get("a") == nil || c.get("c") == nil {
+		t.Errorf("expected the recently used entries to be kept")
+	}
+
+	failed := newBufferedResponse()
+	failed.WriteHeader(http.StatusInternalServerError)
+	c.store("d", failed)
+	if c.get("d") != nil {
+		t.Errorf("expected failed responses not to be cached")
+	}
+
+	fc.Advance(30 * time.Second)
+	c.store("a", ok())
+	fc.Advance(45 * time.Second)
+	c.store("e", ok())
+	if c.get("c") != nil {
+		t.Errorf("expected the expired entry to be evicted")
+	}
+	if c.get("a") == nil || c.get("e") == nil {
+		t.Errorf("expected the current entries to be kept")
+	}
+
+	if n := testutil.ToFloat64(cacheEntries.WithLabelValues(name)); n != 2 {
+		t.Errorf("expected 2 entries, got %v", n)
+	}
+	if n := testutil.ToFloat64(cacheEvictionsCount.WithLabelValues(name)); n != 2 {
+		t.Errorf("expected 2 evictions, got %v", n)
+	}
+}
+
+func TestRefreshBackoff(t *testing.T) {
+	fc := withFakeClock(t)
+	name := "refresh_backoff"
+	c := newResponseCache(name, 10, time.Hour)
+	c.backoff = backoff{initial: time.Second, max: 4 * time.Second}
+
+	var delays []time.Duration
+	for i := 0; i < 4; i++ {
+		c.refreshFailed("a")
+		if n := testutil.ToFloat64(cacheRefreshBackoffs.WithLabelValues(name)); n != 1 {
+			t.Errorf("expected 1 entry backing off, got %v", n)
+		}
+		d := time.Duration(0)
+		for c.backingOff("a") {
+			fc.Advance(time.Second)
+			d += time.Second
+		}
+		delays = append(delays, d)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	for i := range want {
+		if delays[i] != want[i] {
+			t.Errorf("expected backoff delays %v, got %v", want, delays)
+			break
+		}
+	}
+	if n := testutil.ToFloat64(cacheRefreshBackoffs.WithLabelValues(name)); n != 0 {
+		t.Errorf("expected entries whose backoff ended not to be counted, got %v", n)
+	}
+
+	c.refreshFailed("a")
+	c.store("a", newBufferedResponse())
+	if c.backingOff("a") {
+		t.Errorf("expected a stored response to end the backoff")
+	}
+	if n := testutil.ToFloat64(cacheRefreshBackoffs.WithLabelValues(name)); n != 0 {
+		t.Errorf("expected no entries backing off, got %v", n)
+	}
+}
+
+func TestMinInterval(t *testing.T) {
+	fc := withFakeClock(t)
+	path := filepath.Join(t.TempDir(), "m.prom")
+	write := func(v string) {
+		if err := os.WriteFile(path, []byte("m "+v+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	emit := false
+	m := &ModuleConfig{Method: "file", MinInterval: 10 * time.Second, File: FileConfig{Path: path, EmitMtime: &emit}}
+	if err := CheckModuleConfig("min_interval", m); err != nil {
+		t.Fatalf("Failed to check module config: %v", err)
+	}
+	scrape := func() string {
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, httptest.NewRequest("GET", "/proxy?module=min_interval", nil))
+		return rr.Body.String()
+	}
+
+	write("1")
+	scrape()
+	write("2")
+	fc.Advance(5 * time.Second)
+	if got := scrape(); !strings.Contains(got, "m 1") {
+		t.Errorf("expected the previous response within min_interval, got:\n%s", got)
+	}
+	fc.Advance(5 * time.Second)
+	if got := scrape(); !strings.Contains(got, "m 2") {
+		t.Errorf("expected a new response after min_interval, got:\n%s", got)
+	}
+
+	os.Remove(path)
+	fc.Advance(10 * time.Second)
+	scrape()
+	write("3")
+	fc.Advance(5 * time.Second)
+	if got := scrape(); strings.Contains(got, "m 3") {
+		t.Errorf("expected the failed response to be repeated within min_interval, got:\n%s", got)
+	}
+}
+
+func TestBufferResponse(t *testing.T) {
+	withFakeClock(t)
+	path := filepath.Join(t.TempDir(), "m.prom")
+	emit := false
+	m := &ModuleConfig{Method: "file", BufferResponse: true, BufferMaxBytes: 64, File: FileConfig{Path: path, EmitMtime: &emit}}
+	if err := CheckModuleConfig("buffered", m); err != nil {
+		t.Fatalf("Failed to check module config: %v", err)
+	}
+	scrape := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, httptest.NewRequest("GET", "/proxy?module=buffered", nil))
+		return rr
+	}
+
+	if err := os.WriteFile(path, []byte("m 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rr := scrape(); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "m 1") {
+		t.Errorf("expected the buffered response, got %v:\n%s", rr.Code, rr.Body.String())
+	}
+
+	var big strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&big, "m_%d 1\n", i)
+	}
+	if err := os.WriteFile(path, []byte(big.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(bufferOverflowsCount.WithLabelValues("buffered"))
+	rr := scrape()
+	if rr.Code != http.StatusInternalServerError || strings.Contains(rr.Body.String(), "m_0") {
+		t.Errorf("expected an error for the oversized response, got %v:\n%s", rr.Code, rr.Body.String())
+	}
+	if got := testutil.ToFloat64(bufferOverflowsCount.WithLabelValues("buffered")) - before; got != 1 {
+		t.Errorf("expected 1 buffer overflow, got %v", got)
+	}
+	if atomic.LoadInt32(&m.state.up) == 1 {
+		t.Errorf("expected the oversized response to mark the module down")
+	}
+}
+
+func TestMissBackoff(t *testing.T) {
+	fc := withFakeClock(t)
+	path := filepath.Join(t.TempDir(), "m.prom")
+	emit := false
+	m := &ModuleConfig{
+		Method:                "file",
+		CacheTTL:              time.Minute,
+		StaleWhileRevalidate:  time.Minute,
+		FailureBackoffInitial: 10 * time.Second,
+		File:                  FileConfig{Path: path, EmitMtime: &emit},
+	}
+	if err := CheckModuleConfig("miss_backoff", m); err != nil {
+		t.Fatalf("Failed to check module config: %v", err)
+	}
+	scrape := func() int {
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, httptest.NewRequest("GET", "/proxy?module=miss_backoff", nil))
+		return rr.Code
+	}
+
+	if got := scrape(); got != http.StatusInternalServerError {
+		t.Fatalf("expected the missing file to fail the scrape, got %v", got)
+	}
+	if err := os.WriteFile(path, []byte("m 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := scrape(); got != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while backing off, got %v", got)
+	}
+	fc.Advance(10 * time.Second)
+	if got := scrape(); got != http.StatusOK {
+		t.Errorf("expected a scrape once the backoff ended, got %v", got)
+	}
+}
+
+func TestRefreshPanic(t *testing.T) {
+	withFakeClock(t)
+	name := "refresh_panic"
+	// An unchecked http module has no proxy to serve with and panics.
+	m := ModuleConfig{Method: "http", name: name, cache: newResponseCache(name, 10, time.Hour)}
+	m.cache.backoff = backoff{initial: time.Second, max: time.Minute}
+
+	panics := testutil.ToFloat64(modulePanicsCount.WithLabelValues(name))
+	m.refresh("a", httptest.NewRequest("GET", "/proxy?module="+name, nil))
+	if n := testutil.ToFloat64(modulePanicsCount.WithLabelValues(name)) - panics; n != 1 {
+		t.Errorf("expected a panic to be counted, got %v", n)
+	}
+	if n := testutil.ToFloat64(cacheRefreshesCount.WithLabelValues(name, "error")); n != 1 {
+		t.Errorf("expected a failed refresh to be counted, got %v", n)
+	}
+	if !m.cache.backingOff("a") {
+		t.Errorf("expected the panic to back off further refreshes")
+	}
+}
+
+func TestResponseCacheExpire(t *testing.T) {
+	fc := withFakeClock(t)
+	name := "cache_expire"
+	c := newResponseCache(name, 10, time.Minute)
+	c.store("a", newBufferedResponse())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		expireEvery(ctx, time.Minute, c.expire)
+	}()
+	fc.waitTimer(t)
+	fc.Advance(2 * time.Minute)
+	// The next timeout is only set up once the sweep is done.
+	fc.waitTimer(t)
+	cancel()
+	<-done
+
+	c.Lock()
+	n := c.lru.Len()
+	c.Unlock()
+	if n != 0 {
+		t.Errorf("expected the expired entry of an idle cache to be dropped, %d left", n)
+	}
+	if n := testutil.ToFloat64(cacheEntries.WithLabelValues(name)); n != 0 {
+		t.Errorf("expected 0 entries, got %v", n)
+	}
+}
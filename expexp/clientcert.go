@@ -0,0 +1,64 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// parseFingerprint returns the SHA-256 fingerprint s in lower case hex
+// without separators. Upper case and colon separated forms are accepted.
+func parseFingerprint(s string) (string, error) {
+	fp := strings.ToLower(strings.ReplaceAll(s, ":", ""))
+	if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("%q is not a SHA-256 fingerprint", s)
+	}
+	return fp, nil
+}
+
+// clientCertFingerprint returns the fingerprint of the client certificate
+// presented with r, or "" if there is none.
+func clientCertFingerprint(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// clientCertAllowed reports whether r may be served by module m according to
+// its AllowedClientCertFingerprints. It responds with 403 if not.
+func (m ModuleConfig) clientCertAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if m.certFingerprints == nil {
+		return true
+	}
+	fp := clientCertFingerprint(r)
+	if m.certFingerprints[fp] {
+		return true
+	}
+	if fp == "" {
+		log.Infof("Access to module %v forbidden without a client certificate", m.name)
+	} else {
+		log.Infof("Access to module %v forbidden for client certificate %v", m.name, fp)
+	}
+	w.WriteHeader(http.StatusForbidden)
+	_, _ = w.Write([]byte("Forbidden"))
+	return false
+}
@@ -0,0 +1,47 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"context"
+	"time"
+)
+
+// clock is the source of time for all deadline and timeout handling, so tests
+// can replace it and move time forward deterministically.
+type clock interface {
+	Now() time.Time
+	// WithTimeout behaves like context.WithTimeout, with the timeout
+	// measured by this clock.
+	WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) WithTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, d)
+}
+
+var clk clock = realClock{}
+
+// remaining returns the time left until the deadline of ctx, or def if ctx has
+// no deadline.
+func remaining(ctx context.Context, def time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline.Sub(clk.Now())
+	}
+	return def
+}
@@ -0,0 +1,229 @@
+package expexp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeClock is a clock that only moves when advanced by the test.
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimeoutCtx
+	added  chan struct{}
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:   time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		added: make(chan struct{}, 100),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	c.Lock()
+	t := &fakeTimeoutCtx{Context: ctx, cancel: cancel, deadline: c.now.Add(d)}
+	c.timers = append(c.timers, t)
+	c.Unlock()
+	c.added <- struct{}{}
+	return t, cancel
+}
+
+// Advance moves the clock forward, expiring any timeouts that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	var pending []*fakeTimeoutCtx
+	for _, t := range c.timers {
+		if t.deadline.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.expire()
+	}
+	c.timers = pending
+}
+
+// waitTimer blocks until a timeout has been registered with the clock.
+func (c *fakeClock) waitTimer(t *testing.T) {
+	select {
+	case <-c.added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no timeout was set up")
+	}
+}
+
+type fakeTimeoutCtx struct {
+	context.Context
+	cancel   context.CancelFunc
+	deadline time.Time
+
+	mu      sync.Mutex
+	expired bool
+}
+
+func (c *fakeTimeoutCtx) Deadline() (time.Time, bool) { return c.deadline, true }
+
+func (c *fakeTimeoutCtx) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expired {
+		return context.DeadlineExceeded
+	}
+	return c.Context.Err()
+}
+
+func (c *fakeTimeoutCtx) expire() {
+	c.mu.Lock()
+	if c.Context.Err() == nil {
+		c.expired = true
+	}
+	c.mu.Unlock()
+	c.cancel()
+}
+
+func withFakeClock(t *testing.T) *fakeClock {
+	fc := newFakeClock()
+	clk = fc
+	t.Cleanup(func() { clk = realClock{} })
+	return fc
+}
+
+func TestExecTimeout(t *testing.T) {
+	fc := withFakeClock(t)
+
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	mcfg := &ModuleConfig{
+		Method:  "exec",
+		Timeout: time.Second,
+		Exec: ExecConfig{
+			Command: "sh",
+			Args:    []string{"-c", "echo $$ > " + pidFile + "; exec sleep 60"},
+		},
+	}
+	if err := CheckModuleConfig("exec_timeout", mcfg); err != nil {
+		t.Fatalf("Failed to check module config: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		mcfg.ServeHTTP(rr, httptest.NewRequest("GET", "/proxy?module=exec_timeout", nil))
+		close(done)
+	}()
+
+	timeouts := testutil.ToFloat64(proxyTimeoutCount.WithLabelValues("exec_timeout"))
+	fc.waitTimer(t)
+	proc := waitStarted(t, pidFile)
+	select {
+	case <-done:
+		t.Fatal("command finished before the timeout")
+	default:
+	}
+
+	fc.Advance(2 * time.Second)
+	<-done
+	waitKilled(t, proc)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, rr.Code)
+	}
+	if v := testutil.ToFloat64(proxyTimeoutCount.WithLabelValues("exec_timeout")) - timeouts; v != 1 {
+		t.Errorf("expected 1 timeout, got %v", v)
+	}
+}
+
+func TestRemaining(t *testing.T) {
+	fc := withFakeClock(t)
+
+	if d := remaining(context.Background(), time.Minute); d != time.Minute {
+		t.Errorf("expected default without deadline, got %v", d)
+	}
+
+	ctx, cancel := fc.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	fc.Advance(4 * time.Second)
+	if d := remaining(ctx, time.Minute); d != 6*time.Second {
+		t.Errorf("expected 6s remaining, got %v", d)
+	}
+	fc.Advance(10 * time.Second)
+	if d := remaining(ctx, time.Minute); d >= 0 {
+		t.Errorf("expected deadline to have passed, got %v", d)
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Errorf("expected context to be expired, got %v", ctx.Err())
+	}
+}
+
+func TestRotationGraceExpiry(t *testing.T) {
+	fc := withFakeClock(t)
+
+	name := "m"
+	l := &lastResult{}
+	l.store([]*dto.MetricFamily{{Name: &name}})
+
+	fc.Advance(3 * time.Second)
+	mfs, age, ok := l.load(5 * time.Second)
+	if !ok || len(mfs) != 1 || age != 3*time.Second {
+		t.Fatalf("expected stored result aged 3s, got %v, %v, %v", mfs, age, ok)
+	}
+
+	fc.Advance(3 * time.Second)
+	if _, _, ok := l.load(5 * time.Second); ok {
+		t.Fatal("expected stored result to have expired")
+	}
+}
+
+// waitStarted waits for a command to write its pid to pidFile.
+func waitStarted(t *testing.T, pidFile string) *os.Process {
+	for i := 0; i < 500; i++ {
+		bs, err := ioutil.ReadFile(pidFile)
+		if err == nil && bytes.HasSuffix(bs, []byte("\n")) {
+			pid, err := strconv.Atoi(strings.TrimSpace(string(bs)))
+			if err != nil {
+				t.Fatalf("bad pid file, %v", err)
+			}
+			p, err := os.FindProcess(pid)
+			if err != nil {
+				t.Fatalf("command process not found, %v", err)
+			}
+			return p
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("command did not start")
+	return nil
+}
+
+// waitKilled waits for the process to be gone.
+func waitKilled(t *testing.T, p *os.Process) {
+	for i := 0; i < 500; i++ {
+		if p.Signal(syscall.Signal(0)) != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("command was not killed")
+}
@@ -0,0 +1,766 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package expexp implements the modules of exporter_exporter, so they can be
+// served from other programs as well.
+package expexp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is the top level exporter_exporter configuration.
+type Config struct {
+	Global struct {
+		ReadyRequires       []string      `yaml:"ready_requires"`        // no default
+		ReadyTimeout        time.Duration `yaml:"ready_timeout"`         // 0, wait forever
+		HealthWeightModules []string      `yaml:"health_weight_modules"` // all modules
+		MaxConcurrent       int           `yaml:"max_concurrent"`        // 0, unlimited
+		FairQueuing         bool          `yaml:"fair_queuing"`          // false
+		WarmTimeout         time.Duration `yaml:"warm_timeout"`          // 1m
+	}
+	Modules map[string]*ModuleConfig
+	XXX     map[string]interface{} `yaml:",inline"`
+
+	// Admin restricts access to administrative requests. It is not read
+	// from the configuration file.
+	Admin AdminConfig `yaml:"-"`
+	// SafeMode refuses anything that lets requests influence what is run
+	// or read beyond the configuration: command arguments of exec modules,
+	// request parameters passed to http upstreams, shard_param and
+	// administrative requests. It is not read from the configuration file.
+	SafeMode bool `yaml:"-"`
+
+	// warmed is closed once the modules with WarmOnStart have been run by
+	// Run, nil if there are none.
+	warmed   chan struct{}
+	warmOnce sync.Once
+	// ready is the readiness gate served by NewHandler, kept over reloads
+	// by Adopt.
+	ready *readiness
+}
+
+// ModuleConfig configures a single module. Modules are http.Handlers
+// serving the metrics obtained according to Method.
+type ModuleConfig struct {
+	Method                        string                 `yaml:"method"`
+	Timeout                       time.Duration          `yaml:"timeout"`
+	MetricAllowList               []string               `yaml:"metric_allow_list"`                // no default
+	DuplicateLabels               string                 `yaml:"duplicate_labels"`                 // no default
+	LabelKeep                     []string               `yaml:"label_keep"`                       // all labels
+	LabelKeepCollisions           string                 `yaml:"label_keep_collisions"`            // sum
+	MaxHistogramBuckets           int                    `yaml:"max_histogram_buckets"`            // 0, unlimited
+	HistogramBucketsAction        string                 `yaml:"histogram_buckets_action"`         // drop
+	PostTransform                 *PostTransformConfig   `yaml:"post_transform"`                   // no default
+	Listeners                     []string               `yaml:"listeners"`                        // all listeners
+	FailStatus                    int                    `yaml:"fail_status"`                      // as produced by the module
+	ForceFormat                   string                 `yaml:"force_format"`                     // negotiated
+	MaxResponseBytesWindow        time.Duration          `yaml:"max_response_bytes_window"`        // 0, disabled
+	CacheTTL                      time.Duration          `yaml:"cache_ttl"`                        // 0, disabled
+	StaleWhileRevalidate          time.Duration          `yaml:"stale_while_revalidate"`           // 0
+	CacheMaxEntries               int                    `yaml:"cache_max_entries"`                // 1000
+	MinInterval                   time.Duration          `yaml:"min_interval"`                     // 0, disabled
+	BufferResponse                bool                   `yaml:"buffer_response"`                  // false
+	BufferMaxBytes                int64                  `yaml:"buffer_max_bytes"`                 // 16MiB with buffer_response, else unlimited
+	WarmOnStart                   bool                   `yaml:"warm_on_start"`                    // false
+	WarmHeaders                   map[string]string      `yaml:"warm_headers"`                     // no default
+	FailureBackoffInitial         time.Duration          `yaml:"failure_backoff_initial"`          // 0, disabled
+	FailureBackoffMax             time.Duration          `yaml:"failure_backoff_max"`              // 5m
+	ParseFailureThreshold         int                    `yaml:"parse_failure_threshold"`          // 0, disabled
+	ParseFailureCooldown          time.Duration          `yaml:"parse_failure_cooldown"`           // 30s
+	AllowedClientCertFingerprints []string               `yaml:"allowed_client_cert_fingerprints"` // any client
+	MaxConcurrent                 int                    `yaml:"max_concurrent"`                   // 0, unlimited
+	Weight                        int                    `yaml:"weight"`                           // 1
+	MaxRPS                        float64                `yaml:"max_rps"`                          // 0, unlimited
+	ScrapeSamples                 bool                   `yaml:"scrape_samples"`                   // false
+	ScrapeTime                    bool                   `yaml:"scrape_time"`                      // false
+	MonotonicCounters             bool                   `yaml:"monotonic_counters"`               // false
+	MonotonicMaxSeries            int                    `yaml:"monotonic_max_series"`             // 10000
+	DistinctTargetsParam          string                 `yaml:"distinct_targets_param"`           // no default
+	DistinctTargetsWindow         time.Duration          `yaml:"distinct_targets_window"`          // 1h
+	XXX                           map[string]interface{} `yaml:",inline"`
+
+	Exec   ExecConfig   `yaml:"exec"`
+	HTTP   HTTPConfig   `yaml:"http"`
+	File   FileConfig   `yaml:"file"`
+	Stream StreamConfig `yaml:"stream"`
+	Env    EnvConfig    `yaml:"env"`
+
+	name        string
+	metricAllow map[string]bool
+	labelKeep   map[string]bool
+	// certFingerprints holds the parsed AllowedClientCertFingerprints.
+	certFingerprints map[string]bool
+	forceFormat      expfmt.Format
+	cache            *responseCache
+	state            *moduleState
+	monotonic        *monotonicState
+	limiter          *rateLimiter
+	// all is the configuration the module is part of, set for health
+	// modules by Config.Check.
+	all *Config
+	// sched hands out the global max_concurrent slots, set by
+	// Config.Check.
+	sched *scheduler
+}
+
+// HTTPConfig configures a module proxying requests to an http exporter.
+type HTTPConfig struct {
+	Verify                *bool                  `yaml:"verify"`                   // no default
+	TLSInsecureSkipVerify bool                   `yaml:"tls_insecure_skip_verify"` // false
+	TLSCertFile           *string                `yaml:"tls_cert_file"`            // no default
+	TLSKeyFile            *string                `yaml:"tls_key_file"`             // no default
+	TLSCACertFile         *string                `yaml:"tls_ca_cert_file"`         // no default
+	Port                  int                    `yaml:"port"`                     // no default
+	Path                  string                 `yaml:"path"`                     // /metrics
+	Paths                 []string               `yaml:"paths"`                    // no default
+	PathLabel             string                 `yaml:"path_label"`               // no default
+	DisambiguateLabel     string                 `yaml:"disambiguate_label"`       // no default
+	DisambiguateValues    map[string]string      `yaml:"disambiguate_values"`      // the paths
+	HelpSource            bool                   `yaml:"help_source"`              // false
+	Scheme                string                 `yaml:"scheme"`                   // http
+	Address               string                 `yaml:"address"`                  // 127.0.0.1
+	Headers               map[string]string      `yaml:"headers"`                  // no default
+	BasicAuthUsername     string                 `yaml:"basic_auth_username"`      // no default
+	BasicAuthPassword     string                 `yaml:"basic_auth_password"`      // no default
+	ConnectRetries        int                    `yaml:"connect_retries"`          // 0
+	RetryInitialBackoff   time.Duration          `yaml:"retry_initial_backoff"`    // 100ms
+	RetryMaxBackoff       time.Duration          `yaml:"retry_max_backoff"`        // 5s
+	RetryJitter           float64                `yaml:"retry_jitter"`             // 0
+	DeadlineMargin        time.Duration          `yaml:"deadline_margin"`          // 0
+	ConnectTimeout        time.Duration          `yaml:"connect_timeout"`          // 0, the module timeout
+	BodyTimeout           time.Duration          `yaml:"body_timeout"`             // 0, the module timeout
+	ParseTimeout          time.Duration          `yaml:"parse_timeout"`            // 0, the module timeout
+	ShardParam            string                 `yaml:"shard_param"`              // no default
+	Shards                map[string]string      `yaml:"shards"`                   // no default
+	FreshnessProbe        *FreshnessProbeConfig  `yaml:"freshness_probe"`          // no default
+	UpstreamAccept        string                 `yaml:"upstream_accept"`          // the scraper's Accept header
+	OAuth2                *OAuth2Config          `yaml:"oauth2"`                   // no default
+	XXX                   map[string]interface{} `yaml:",inline"`
+
+	tlsConfig              *tls.Config
+	shardURLs              map[string]*url.URL
+	client                 *http.Client
+	pathDirectors          []func(*http.Request)
+	disambiguateValues     []string
+	mcfg                   *ModuleConfig
+	*httputil.ReverseProxy `json:"-"`
+}
+
+// ExecConfig configures a module running a command producing metrics.
+type ExecConfig struct {
+	Command string                 `yaml:"command"`
+	Args    []string               `yaml:"args"`
+	Env     map[string]string      `yaml:"env"`
+	Lazy    bool                   `yaml:"lazy"` // false
+	XXX     map[string]interface{} `yaml:",inline"`
+
+	mcfg *ModuleConfig
+}
+
+// FileConfig configures a module serving metrics read from a file.
+type FileConfig struct {
+	Path                 string        `yaml:"path"`
+	UseMtime             bool          `yaml:"use_mtime"`
+	MtimeTypes           []string      `yaml:"mtime_types"`        // all types
+	MtimeSkipCreated     bool          `yaml:"mtime_skip_created"` // false
+	MtimeSkipInfo        bool          `yaml:"mtime_skip_info"`    // false
+	IsGlob               bool          `yaml:"glob"`
+	RotationGrace        time.Duration `yaml:"rotation_grace"`         // 0, disabled
+	RejectFutureMtime    bool          `yaml:"reject_future_mtime"`    // false
+	FutureMtimeTolerance time.Duration `yaml:"future_mtime_tolerance"` // 5s
+	EmitMtime            *bool         `yaml:"emit_mtime"`             // true
+	ContentType          string        `yaml:"content_type"`           // negotiated
+	PresenceMetric       string        `yaml:"presence_metric"`        // no default
+
+	mtimeTypes map[dto.MetricType]bool
+	rotation   *lastResult
+	mcfg       *ModuleConfig
+}
+
+// ReadConfig parses and checks a configuration file.
+func ReadConfig(r io.Reader) (*Config, error) {
+	buf := bytes.Buffer{}
+	io.Copy(&buf, r)
+	cfg := Config{}
+
+	data, err := applyTemplates(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(data, &cfg)
+
+	if len(cfg.XXX) != 0 {
+		return nil, fmt.Errorf("Unknown configuration fields: %v", cfg.XXX)
+	}
+
+	for s := range cfg.Modules {
+		if err := CheckModuleConfig(s, cfg.Modules[s]); err != nil {
+			return nil, fmt.Errorf("bad config for module %s, %w", s, err)
+		}
+	}
+
+	return &cfg, err
+}
+
+// Check verifies the settings of cfg that refer to its modules. It must be
+// called once all modules have been added.
+func (cfg *Config) Check() error {
+	for _, name := range cfg.Global.ReadyRequires {
+		if _, ok := cfg.Modules[name]; !ok {
+			return fmt.Errorf("ready_requires lists unknown module %s", name)
+		}
+	}
+	if cfg.Global.ReadyTimeout < 0 {
+		return fmt.Errorf("ready_timeout must not be negative")
+	}
+	for _, name := range cfg.Global.HealthWeightModules {
+		if _, ok := cfg.Modules[name]; !ok {
+			return fmt.Errorf("health_weight_modules lists unknown module %s", name)
+		}
+	}
+	if cfg.SafeMode && len(cfg.Admin.ACL) != 0 {
+		return fmt.Errorf("administrative requests can not be allowed in safe mode")
+	}
+	for name, m := range cfg.Modules {
+		if cfg.SafeMode && m.Method == "http" && m.HTTP.ShardParam != "" {
+			return fmt.Errorf("module %v can not use shard_param in safe mode", name)
+		}
+	}
+	if cfg.Global.MaxConcurrent < 0 {
+		return fmt.Errorf("global max_concurrent must not be negative")
+	}
+	if cfg.Global.WarmTimeout < 0 {
+		return fmt.Errorf("warm_timeout must not be negative")
+	}
+	if cfg.Global.WarmTimeout == 0 {
+		cfg.Global.WarmTimeout = defaultWarmTimeout
+	}
+	if len(cfg.warmModules()) != 0 {
+		cfg.warmed = make(chan struct{})
+	}
+	var sched *scheduler
+	if cfg.Global.MaxConcurrent > 0 {
+		sched = newScheduler(cfg.Global.MaxConcurrent, cfg.Global.FairQueuing)
+	}
+	for _, m := range cfg.Modules {
+		if m.Method == "health" {
+			m.all = cfg
+		} else {
+			m.sched = sched
+		}
+	}
+	return nil
+}
+
+// SetEmitMtimeDefault sets whether file modules that do not configure
+// emit_mtime add the expexp_file_mtime_timestamp metric.
+func (cfg *Config) SetEmitMtimeDefault(emit bool) {
+	for _, m := range cfg.Modules {
+		if m.Method == "file" && m.File.EmitMtime == nil {
+			m.File.EmitMtime = &emit
+		}
+	}
+}
+
+// ReadModuleConfig parses and checks the configuration of a single module, as
+// found in the files of a configuration directory.
+func ReadModuleConfig(name string, r io.Reader) (*ModuleConfig, error) {
+	buf := bytes.Buffer{}
+	io.Copy(&buf, r)
+	cfg := ModuleConfig{}
+
+	err := yaml.Unmarshal(buf.Bytes(), &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = CheckModuleConfig(name, &cfg); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// CheckModuleConfig validates a module configuration, fills in defaults and
+// prepares it to serve requests under the given module name. It must be
+// called on any ModuleConfig not obtained from ReadConfig or
+// ReadModuleConfig before it is used.
+func CheckModuleConfig(name string, cfg *ModuleConfig) error {
+	if len(cfg.XXX) != 0 {
+		return fmt.Errorf("unknown module configuration fields: %v", cfg.XXX)
+	}
+
+	cfg.name = name
+	cfg.state = &moduleState{}
+
+	if len(cfg.MetricAllowList) != 0 {
+		cfg.metricAllow = make(map[string]bool, len(cfg.MetricAllowList))
+		for _, n := range cfg.MetricAllowList {
+			if n == "" {
+				return fmt.Errorf("metric_allow_list must not contain empty names")
+			}
+			cfg.metricAllow[n] = true
+		}
+	}
+
+	switch cfg.DuplicateLabels {
+	case "", duplicateLabelsError, duplicateLabelsFirst, duplicateLabelsLast:
+	default:
+		return fmt.Errorf("duplicate_labels must be one of error, first or last, not %q", cfg.DuplicateLabels)
+	}
+
+	if cfg.LabelKeep != nil {
+		cfg.labelKeep = make(map[string]bool, len(cfg.LabelKeep))
+		for _, n := range cfg.LabelKeep {
+			if !model.LabelName(n).IsValid() {
+				return fmt.Errorf("label_keep %q is not a valid label name", n)
+			}
+			cfg.labelKeep[n] = true
+		}
+	}
+	switch cfg.LabelKeepCollisions {
+	case "":
+		cfg.LabelKeepCollisions = labelKeepSum
+	case labelKeepSum, labelKeepError:
+	default:
+		return fmt.Errorf("label_keep_collisions must be one of sum or error, not %q", cfg.LabelKeepCollisions)
+	}
+
+	if cfg.MaxHistogramBuckets < 0 {
+		return fmt.Errorf("max_histogram_buckets must not be negative")
+	}
+	switch cfg.HistogramBucketsAction {
+	case "":
+		cfg.HistogramBucketsAction = histogramBucketsDrop
+	case histogramBucketsDrop, histogramBucketsCollapse, histogramBucketsReject:
+	default:
+		return fmt.Errorf("histogram_buckets_action must be one of drop, collapse or reject, not %q", cfg.HistogramBucketsAction)
+	}
+
+	if cfg.PostTransform != nil {
+		if err := cfg.PostTransform.check(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.FailStatus != 0 && (cfg.FailStatus < 200 || cfg.FailStatus > 599 || http.StatusText(cfg.FailStatus) == "") {
+		return fmt.Errorf("fail_status %d is not a valid HTTP status", cfg.FailStatus)
+	}
+
+	if cfg.MaxResponseBytesWindow < 0 {
+		return fmt.Errorf("max_response_bytes_window must not be negative")
+	}
+
+	if len(cfg.AllowedClientCertFingerprints) != 0 {
+		cfg.certFingerprints = make(map[string]bool, len(cfg.AllowedClientCertFingerprints))
+		for _, s := range cfg.AllowedClientCertFingerprints {
+			fp, err := parseFingerprint(s)
+			if err != nil {
+				return fmt.Errorf("invalid allowed_client_cert_fingerprints, %w", err)
+			}
+			cfg.certFingerprints[fp] = true
+		}
+	}
+
+	if cfg.MaxConcurrent < 0 {
+		return fmt.Errorf("max_concurrent must not be negative")
+	}
+	if cfg.MaxConcurrent > 0 {
+		cfg.state.slots = make(chan struct{}, cfg.MaxConcurrent)
+	}
+	switch cfg.ForceFormat {
+	case "":
+	case "text":
+		cfg.forceFormat = expfmt.FmtText
+	case "protobuf":
+		cfg.forceFormat = expfmt.FmtProtoDelim
+	case "openmetrics":
+		return fmt.Errorf("force_format openmetrics is not supported, only text or protobuf")
+	default:
+		return fmt.Errorf("unknown force_format %q, must be text or protobuf", cfg.ForceFormat)
+	}
+
+	if cfg.Weight < 0 {
+		return fmt.Errorf("weight must not be negative")
+	}
+	if cfg.Weight == 0 {
+		cfg.Weight = 1
+	}
+
+	if cfg.ParseFailureThreshold < 0 || cfg.ParseFailureCooldown < 0 {
+		return fmt.Errorf("parse_failure_threshold and parse_failure_cooldown must not be negative")
+	}
+	if cfg.ParseFailureThreshold > 0 && cfg.ParseFailureCooldown == 0 {
+		cfg.ParseFailureCooldown = defaultParseFailureCooldown
+	}
+
+	if cfg.CacheTTL < 0 || cfg.StaleWhileRevalidate < 0 || cfg.CacheMaxEntries < 0 {
+		return fmt.Errorf("cache_ttl, stale_while_revalidate and cache_max_entries must not be negative")
+	}
+	if cfg.StaleWhileRevalidate > 0 && cfg.CacheTTL == 0 {
+		return fmt.Errorf("stale_while_revalidate requires cache_ttl")
+	}
+	if cfg.FailureBackoffInitial < 0 || cfg.FailureBackoffMax < 0 {
+		return fmt.Errorf("failure_backoff_initial and failure_backoff_max must not be negative")
+	}
+	if cfg.FailureBackoffInitial > 0 {
+		if cfg.StaleWhileRevalidate == 0 {
+			return fmt.Errorf("failure_backoff_initial requires stale_while_revalidate")
+		}
+		if cfg.FailureBackoffMax == 0 {
+			cfg.FailureBackoffMax = defaultFailureBackoffMax
+		}
+		if cfg.FailureBackoffMax < cfg.FailureBackoffInitial {
+			return fmt.Errorf("failure_backoff_max must not be below failure_backoff_initial")
+		}
+	}
+	if cfg.MaxRPS < 0 {
+		return fmt.Errorf("max_rps must not be negative")
+	}
+	if cfg.MaxRPS > 0 {
+		cfg.limiter = newRateLimiter(cfg.MaxRPS)
+	}
+	if cfg.DistinctTargetsWindow < 0 {
+		return fmt.Errorf("distinct_targets_window must not be negative")
+	}
+	if cfg.DistinctTargetsWindow == 0 {
+		cfg.DistinctTargetsWindow = defaultDistinctTargetsWindow
+	}
+
+	if cfg.MonotonicMaxSeries < 0 {
+		return fmt.Errorf("monotonic_max_series must not be negative")
+	}
+	if cfg.MonotonicCounters {
+		if cfg.MonotonicMaxSeries == 0 {
+			cfg.MonotonicMaxSeries = defaultMonotonicMaxSeries
+		}
+		cfg.monotonic = newMonotonicState(cfg.MonotonicMaxSeries)
+	}
+
+	if cfg.MinInterval < 0 {
+		return fmt.Errorf("min_interval must not be negative")
+	}
+	if cfg.MinInterval > 0 && cfg.CacheTTL > 0 {
+		return fmt.Errorf("min_interval and cache_ttl can not be combined")
+	}
+	if cfg.CacheMaxEntries == 0 {
+		cfg.CacheMaxEntries = defaultCacheMaxEntries
+	}
+	if len(cfg.WarmHeaders) != 0 && !cfg.WarmOnStart {
+		return fmt.Errorf("warm_headers requires warm_on_start")
+	}
+	if cfg.BufferMaxBytes < 0 {
+		return fmt.Errorf("buffer_max_bytes must not be negative")
+	}
+	if cfg.BufferResponse && cfg.BufferMaxBytes == 0 {
+		cfg.BufferMaxBytes = defaultBufferMaxBytes
+	}
+	if cfg.MinInterval > 0 {
+		cfg.cache = newResponseCache(name, cfg.CacheMaxEntries, cfg.MinInterval)
+		cfg.cache.keepErrors = true
+	}
+	if cfg.CacheTTL > 0 {
+		cfg.cache = newResponseCache(name, cfg.CacheMaxEntries, cfg.CacheTTL+cfg.StaleWhileRevalidate)
+		cfg.cache.backoff = backoff{initial: cfg.FailureBackoffInitial, max: cfg.FailureBackoffMax}
+	}
+
+	switch cfg.Method {
+	case "http":
+		if len(cfg.HTTP.XXX) != 0 {
+			return fmt.Errorf("Unknown http module configuration fields: %v", cfg.HTTP.XXX)
+		}
+
+		if cfg.HTTP.Port == 0 && len(cfg.HTTP.Shards) == 0 {
+			return fmt.Errorf("module %v must have a non-zero port set", name)
+		}
+		if (cfg.HTTP.ShardParam == "") != (len(cfg.HTTP.Shards) == 0) {
+			return fmt.Errorf("module %v must set both shard_param and shards, or neither", name)
+		}
+		cfg.HTTP.shardURLs = nil
+		for k, v := range cfg.HTTP.Shards {
+			u, err := url.Parse(v)
+			if err != nil {
+				return fmt.Errorf("shard %q has an invalid url, %w", k, err)
+			}
+			if k == "" || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("shard %q must have a non-empty name and an http or https url, not %q", k, v)
+			}
+			if cfg.HTTP.shardURLs == nil {
+				cfg.HTTP.shardURLs = make(map[string]*url.URL, len(cfg.HTTP.Shards))
+			}
+			cfg.HTTP.shardURLs[k] = u
+		}
+		if cfg.HTTP.Verify == nil {
+			v := true
+			cfg.HTTP.Verify = &v
+		}
+		if cfg.HTTP.Scheme == "" {
+			cfg.HTTP.Scheme = "http"
+		}
+		if len(cfg.HTTP.Paths) != 0 && cfg.HTTP.Path != "" {
+			return fmt.Errorf("module %v can not set both path and paths", name)
+		}
+		if len(cfg.HTTP.Paths) == 0 && cfg.HTTP.Path == "" {
+			cfg.HTTP.Path = "/metrics"
+		}
+		if cfg.HTTP.PathLabel != "" && !model.LabelName(cfg.HTTP.PathLabel).IsValid() {
+			return fmt.Errorf("path_label %q is not a valid label name", cfg.HTTP.PathLabel)
+		}
+		if cfg.HTTP.DisambiguateLabel != "" {
+			if len(cfg.HTTP.Paths) == 0 {
+				return fmt.Errorf("disambiguate_label requires paths")
+			}
+			if !model.LabelName(cfg.HTTP.DisambiguateLabel).IsValid() {
+				return fmt.Errorf("disambiguate_label %q is not a valid label name", cfg.HTTP.DisambiguateLabel)
+			}
+		}
+		if cfg.HTTP.HelpSource && len(cfg.HTTP.Paths) == 0 {
+			return fmt.Errorf("help_source requires paths")
+		}
+		for p := range cfg.HTTP.DisambiguateValues {
+			known := false
+			for _, cp := range cfg.HTTP.Paths {
+				known = known || cp == p
+			}
+			if !known {
+				return fmt.Errorf("disambiguate_values lists %v, which is not one of the paths", p)
+			}
+		}
+		cfg.HTTP.disambiguateValues = nil
+		for _, p := range cfg.HTTP.Paths {
+			v, ok := cfg.HTTP.DisambiguateValues[p]
+			if !ok {
+				v = p
+			}
+			cfg.HTTP.disambiguateValues = append(cfg.HTTP.disambiguateValues, v)
+		}
+		if cfg.HTTP.Address == "" {
+			cfg.HTTP.Address = "localhost"
+		}
+		if cfg.HTTP.UpstreamAccept != "" {
+			if err := checkAccept(cfg.HTTP.UpstreamAccept); err != nil {
+				return fmt.Errorf("invalid upstream_accept, %w", err)
+			}
+		}
+
+		tlsConfig, err := cfg.HTTP.getTLSConfig()
+		if err != nil {
+			return fmt.Errorf("could not create tls config, %w", err)
+		}
+
+		if cfg.HTTP.DeadlineMargin < 0 || (cfg.Timeout != 0 && cfg.HTTP.DeadlineMargin >= cfg.Timeout) {
+			return fmt.Errorf("deadline_margin must not be negative and must be shorter than the module timeout")
+		}
+		if cfg.HTTP.ConnectTimeout < 0 || cfg.HTTP.BodyTimeout < 0 || cfg.HTTP.ParseTimeout < 0 {
+			return fmt.Errorf("connect_timeout, body_timeout and parse_timeout must not be negative")
+		}
+		if cfg.HTTP.ConnectRetries < 0 {
+			return fmt.Errorf("connect_retries must not be negative")
+		}
+		if cfg.HTTP.RetryInitialBackoff == 0 {
+			cfg.HTTP.RetryInitialBackoff = 100 * time.Millisecond
+		}
+		if cfg.HTTP.RetryMaxBackoff == 0 {
+			cfg.HTTP.RetryMaxBackoff = 5 * time.Second
+		}
+		if cfg.HTTP.RetryInitialBackoff < 0 || cfg.HTTP.RetryMaxBackoff < cfg.HTTP.RetryInitialBackoff {
+			return fmt.Errorf("retry_initial_backoff must be positive and not larger than retry_max_backoff")
+		}
+		if cfg.HTTP.RetryJitter < 0 || cfg.HTTP.RetryJitter > 1 {
+			return fmt.Errorf("retry_jitter must be between 0 and 1")
+		}
+
+		for _, cert := range tlsConfig.Certificates {
+			if err := ObserveCertificateExpiry("module:"+name, cert); err != nil {
+				return fmt.Errorf("could not parse TLS certificate, %w", err)
+			}
+		}
+
+		cfg.HTTP.tlsConfig = tlsConfig
+		transport := &http.Transport{TLSClientConfig: tlsConfig}
+		dialer := &net.Dialer{Timeout: cfg.HTTP.ConnectTimeout}
+		transport.DialContext = dialer.DialContext
+		if cfg.HTTP.ConnectRetries > 0 {
+			transport.DialContext = retryDial(name, dialer.DialContext, cfg.HTTP.ConnectRetries, backoff{
+				initial: cfg.HTTP.RetryInitialBackoff,
+				max:     cfg.HTTP.RetryMaxBackoff,
+				jitter:  cfg.HTTP.RetryJitter,
+			})
+		}
+
+		var rt http.RoundTripper = transport
+		if cfg.HTTP.OAuth2 != nil {
+			if err := cfg.HTTP.OAuth2.check(); err != nil {
+				return err
+			}
+			if cfg.HTTP.BasicAuthUsername != "" {
+				return fmt.Errorf("http modules can not use both basic auth and oauth2")
+			}
+			rt = cfg.HTTP.OAuth2.transport(transport)
+		}
+
+		// Multiple paths are scraped and merged, and freshness probes
+		// made, sharing the connections to the upstream.
+		cfg.HTTP.client = &http.Client{Transport: rt}
+		if cfg.HTTP.FreshnessProbe != nil {
+			if err := cfg.HTTP.FreshnessProbe.check(cfg); err != nil {
+				return err
+			}
+		}
+
+		if len(cfg.HTTP.Paths) != 0 {
+			cfg.HTTP.pathDirectors = nil
+			for _, p := range cfg.HTTP.Paths {
+				dirFunc, err := cfg.getReverseProxyDirectorFunc(p)
+				if err != nil {
+					return err
+				}
+				cfg.HTTP.pathDirectors = append(cfg.HTTP.pathDirectors, dirFunc)
+			}
+			break
+		}
+
+		dirFunc, err := cfg.getReverseProxyDirectorFunc(cfg.HTTP.Path)
+		if err != nil {
+			return err
+		}
+
+		cfg.HTTP.ReverseProxy = &httputil.ReverseProxy{
+			Transport:    rt,
+			Director:     dirFunc,
+			ErrorHandler: cfg.getReverseProxyErrorHandlerFunc(),
+		}
+		if *cfg.HTTP.Verify || cfg.hasPostProcess() || cfg.HTTP.BodyTimeout > 0 || cfg.forceFormat != "" {
+			cfg.HTTP.ReverseProxy.ModifyResponse = cfg.getReverseProxyModifyResponseFunc()
+		}
+	case "exec":
+		if len(cfg.Exec.XXX) != 0 {
+			return fmt.Errorf("Unknown exec module configuration fields: %v", cfg.Exec.XXX)
+		}
+	case "file":
+		if cfg.File.Path == "" {
+			return fmt.Errorf("Path argument for file module is mandatory")
+		}
+		if cfg.File.PresenceMetric != "" && !model.IsValidMetricName(model.LabelValue(cfg.File.PresenceMetric)) {
+			return fmt.Errorf("presence_metric %q is not a valid metric name", cfg.File.PresenceMetric)
+		}
+		if cfg.File.ContentType != "" {
+			if _, _, err := mime.ParseMediaType(cfg.File.ContentType); err != nil {
+				return fmt.Errorf("invalid content_type %q, %w", cfg.File.ContentType, err)
+			}
+		}
+		if cfg.File.FutureMtimeTolerance == 0 {
+			cfg.File.FutureMtimeTolerance = 5 * time.Second
+		}
+		if cfg.File.RotationGrace > 0 {
+			cfg.File.rotation = &lastResult{}
+		}
+		if len(cfg.File.MtimeTypes) != 0 {
+			cfg.File.mtimeTypes = make(map[dto.MetricType]bool)
+			for _, t := range cfg.File.MtimeTypes {
+				mt, ok := dto.MetricType_value[strings.ToUpper(t)]
+				if !ok {
+					return fmt.Errorf("unknown metric type %q in mtime_types", t)
+				}
+				cfg.File.mtimeTypes[dto.MetricType(mt)] = true
+			}
+		}
+	case "stream":
+		if err := cfg.Stream.check(); err != nil {
+			return err
+		}
+	case "env":
+		if err := cfg.Env.check(); err != nil {
+			return err
+		}
+	case "sentinel":
+		// Sentinel modules must never fail, so nothing may process their
+		// output.
+		if cfg.hasPostProcess() {
+			return fmt.Errorf("sentinel modules can not filter or transform metrics")
+		}
+	case "health":
+	default:
+		return fmt.Errorf("Unknown module method: %v", cfg.Method)
+	}
+
+	return nil
+}
+
+// acceptedFormats are the media types of the exposition formats, which
+// upstream_accept may ask for.
+var acceptedFormats = map[string]bool{
+	"text/plain":                      true,
+	"application/vnd.google.protobuf": true,
+	"application/openmetrics-text":    true,
+	"*/*":                             true,
+}
+
+// checkAccept verifies that the Accept header value v only lists exposition
+// formats.
+func checkAccept(v string) error {
+	for _, part := range strings.Split(v, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			return fmt.Errorf("%q is not a media type, %w", part, err)
+		}
+		if !acceptedFormats[mt] {
+			return fmt.Errorf("%q is not an exposition format", mt)
+		}
+	}
+	return nil
+}
+
+func (c HTTPConfig) getTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: c.TLSInsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if c.TLSCACertFile != nil {
+		caCert, err := ioutil.ReadFile(*c.TLSCACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ca from %v, %w", *c.TLSCACertFile, err)
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		config.ClientCAs.AppendCertsFromPEM(caCert)
+	}
+	if c.TLSCertFile != nil && c.TLSKeyFile != nil {
+		cert, err := tls.LoadX509KeyPair(*c.TLSCertFile, *c.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading TLS credentials, %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminConfig restricts access to the administrative features of the
+// handler, such as counting the series of a module. They are refused to all
+// clients unless ACL is set.
+type AdminConfig struct {
+	ACL []net.IPNet
+	// TrustedProxies are the networks of reverse proxies whose
+	// X-Forwarded-For and X-Real-IP headers are used to find the client
+	// address.
+	TrustedProxies []net.IPNet
+}
+
+// restrict returns h, only accessible to admin clients.
+func (a AdminConfig) restrict(h http.Handler) http.Handler {
+	return IPAddressAuthMiddleware{Handler: h, ACL: a.ACL, TrustedProxies: a.TrustedProxies}
+}
+
+// countSeries returns the number of series exposed for mf. Summaries and
+// histograms count their quantiles or buckets plus the _sum and _count
+// series.
+func countSeries(mf *dto.MetricFamily) int {
+	n := 0
+	for _, m := range mf.GetMetric() {
+		switch mf.GetType() {
+		case dto.MetricType_SUMMARY:
+			n += len(m.GetSummary().GetQuantile()) + 2
+		case dto.MetricType_HISTOGRAM:
+			bs := m.GetHistogram().GetBucket()
+			n += len(bs) + 2
+			if len(bs) == 0 || !math.IsInf(bs[len(bs)-1].GetUpperBound(), +1) {
+				n++
+			}
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+var (
+	scrapeSamplesName = "expexp_scrape_samples"
+	scrapeSamplesHelp = "Number of samples returned by the module scrape"
+)
+
+// scrapeSamples returns a family with the number of series in mfs, added to
+// the response of module name when ScrapeSamples is set.
+func scrapeSamples(name string, mfs []*dto.MetricFamily) *dto.MetricFamily {
+	n := 0
+	for _, mf := range mfs {
+		n += countSeries(mf)
+	}
+	v := float64(n)
+	return &dto.MetricFamily{
+		Name: &scrapeSamplesName,
+		Help: &scrapeSamplesHelp,
+		Type: &mtimeType,
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{{Name: &mtimeLabelModule, Value: &name}},
+			Gauge: &dto.Gauge{Value: &v},
+		}},
+	}
+}
+
+// scrapeCount summarizes the response of a module.
+type scrapeCount struct {
+	Status   int     `json:"status"`
+	Families int     `json:"families"`
+	Series   int     `json:"series"`
+	Bytes    int     `json:"bytes"`
+	Duration float64 `json:"duration"`
+}
+
+// serveCount runs module m for r like a normal scrape, but only responds
+// with the number of metric families and series and the size of the
+// response, as JSON.
+func serveCount(m *ModuleConfig, w http.ResponseWriter, r *http.Request) {
+	nr := r.Clone(r.Context())
+	qvs := nr.URL.Query()
+	qvs.Del("count")
+	nr.URL.RawQuery = qvs.Encode()
+	nr.Header.Del("Accept-Encoding")
+
+	st := clk.Now()
+	resp := newBufferedResponse()
+	m.ServeHTTP(resp, nr)
+
+	res := scrapeCount{
+		Status:   resp.status,
+		Bytes:    resp.body.Len(),
+		Duration: clk.Now().Sub(st).Seconds(),
+	}
+	if resp.status == http.StatusOK {
+		dec := expfmt.NewDecoder(bytes.NewReader(resp.body.Bytes()), expfmt.ResponseFormat(resp.header))
+		for {
+			var mf dto.MetricFamily
+			err := dec.Decode(&mf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Warnf("Counting series of module %v failed, %v", m.name, err)
+				http.Error(w, "Failed to parse the module response", http.StatusInternalServerError)
+				return
+			}
+			res.Families++
+			res.Series += countSeries(&mf)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Error(err)
+	}
+}
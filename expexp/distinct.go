@@ -0,0 +1,88 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxDistinctTargets bounds the values remembered per window, the
+	// estimate does not grow beyond twice that.
+	maxDistinctTargets = 10000
+	// defaultDistinctTargetsWindow is the window distinct values are counted
+	// in unless distinct_targets_window is set.
+	defaultDistinctTargetsWindow = time.Hour
+)
+
+var moduleDistinctTargets = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "expexp_module_distinct_targets",
+		Help: "Estimated number of distinct values of the distinct_targets_param of a module requested within the last one to two distinct_targets_window",
+	},
+	[]string{"module"},
+)
+
+// distinctTargets counts the distinct values of a request parameter in the
+// current and the previous window. Values are kept as hashes, at most
+// maxDistinctTargets per window.
+type distinctTargets struct {
+	sync.Mutex
+	start time.Time
+	cur   map[uint64]struct{}
+	prev  map[uint64]struct{}
+	// n is the number of values in cur or prev.
+	n int
+}
+
+// observe records value v, seen in a request to module name.
+func (d *distinctTargets) observe(name, v string, window time.Duration) {
+	h := fnv.New64a()
+	h.Write([]byte(v))
+	sum := h.Sum64()
+
+	d.Lock()
+	defer d.Unlock()
+	now := clk.Now()
+	if el := now.Sub(d.start); d.cur == nil || el >= window {
+		d.prev = d.cur
+		if el >= 2*window {
+			d.prev = nil
+		}
+		d.cur = make(map[uint64]struct{})
+		d.start = now
+		d.n = len(d.prev)
+	}
+	if _, ok := d.cur[sum]; !ok && len(d.cur) < maxDistinctTargets {
+		d.cur[sum] = struct{}{}
+		if _, ok := d.prev[sum]; !ok {
+			d.n++
+		}
+	}
+	moduleDistinctTargets.WithLabelValues(name).Set(float64(d.n))
+}
+
+// observeTarget records the distinct_targets_param value of r, if the
+// module counts them.
+func (m ModuleConfig) observeTarget(r *http.Request) {
+	if m.DistinctTargetsParam == "" || m.state == nil {
+		return
+	}
+	m.state.targets.observe(m.name, r.URL.Query().Get(m.DistinctTargetsParam), m.DistinctTargetsWindow)
+}
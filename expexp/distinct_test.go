@@ -0,0 +1,36 @@
+package expexp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDistinctTargets(t *testing.T) {
+	fc := withFakeClock(t)
+	name := "distinct"
+	var d distinctTargets
+	count := func() float64 { return testutil.ToFloat64(moduleDistinctTargets.WithLabelValues(name)) }
+
+	for i := 0; i < 5; i++ {
+		d.observe(name, fmt.Sprint("host", i%3), time.Hour)
+	}
+	if n := count(); n != 3 {
+		t.Errorf("expected 3 distinct targets, got %v", n)
+	}
+
+	fc.Advance(time.Hour)
+	d.observe(name, "host1", time.Hour)
+	d.observe(name, "host7", time.Hour)
+	if n := count(); n != 4 {
+		t.Errorf("expected 4 distinct targets over two windows, got %v", n)
+	}
+
+	fc.Advance(2 * time.Hour)
+	d.observe(name, "host1", time.Hour)
+	if n := count(); n != 1 {
+		t.Errorf("expected the old windows to be forgotten, got %v", n)
+	}
+}
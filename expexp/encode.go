@@ -0,0 +1,106 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// flushBytes is the amount of encoded output after which it is flushed to
+// the client.
+const flushBytes = 32 << 10
+
+// gzipAccepted reports whether the client accepts gzip compressed responses.
+func gzipAccepted(h http.Header) bool {
+	for _, part := range strings.Split(h.Get("Accept-Encoding"), ",") {
+		part = strings.TrimSpace(part)
+		if part == "gzip" || strings.HasPrefix(part, "gzip;") {
+			return true
+		}
+	}
+	return false
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
+// serveGatherer gathers the metrics of g and streams them to w, in the
+// format negotiated with the client and compressed if the client accepts
+// it. All families are gathered into memory first, their encoding is written
+// as it is produced and flushed regularly, so the encoded response is never
+// held in memory as a whole.
+//
+// Gather errors result in the usual 500 response. Once writing has started
+// the status can not be changed any more, so an encoding error aborts the
+// connection instead, making sure the client does not take the truncated
+// output for a complete response. Callers outside of net/http have to
+// recover http.ErrAbortHandler themselves.
+func serveGatherer(w http.ResponseWriter, r *http.Request, g prometheus.Gatherer) {
+	mfs, err := g.Gather()
+	if err != nil {
+		http.Error(w, "An error has occurred while serving metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	format := expfmt.Negotiate(r.Header)
+	w.Header().Set("Content-Type", string(format))
+
+	out := io.Writer(w)
+	var gz *gzip.Writer
+	if gzipAccepted(r.Header) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+	// An empty set of families writes nothing, it is still a successful
+	// scrape.
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	cw := &countingWriter{w: out}
+	enc := expfmt.NewEncoder(cw, format)
+	flushed := 0
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			log.Warnf("Failed to encode metric family %v, aborting response, %v", mf.GetName(), err)
+			panic(http.ErrAbortHandler)
+		}
+		if flusher != nil && cw.n-flushed >= flushBytes {
+			if gz != nil {
+				gz.Flush()
+			}
+			flusher.Flush()
+			flushed = cw.n
+		}
+	}
+	if gz != nil {
+		gz.Close()
+	}
+}
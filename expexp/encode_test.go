@@ -0,0 +1,25 @@
+package expexp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEmptyScrapeSucceeds(t *testing.T) {
+	withFakeClock(t)
+	t.Setenv("EXPEXP_EMPTY_METRICS", "")
+	m := &ModuleConfig{Method: "env", Env: EnvConfig{EnvVar: "EXPEXP_EMPTY_METRICS"}}
+	if err := CheckModuleConfig("empty", m); err != nil {
+		t.Fatalf("Failed to check module config: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest("GET", "/proxy?module=empty", nil))
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("expected an empty 200 response, got %v:\n%s", rr.Code, rr.Body.String())
+	}
+	if atomic.LoadInt32(&m.state.up) != 1 || len(m.state.errors.latest()) != 0 {
+		t.Errorf("expected the empty scrape to count as a success")
+	}
+}
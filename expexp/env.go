@@ -0,0 +1,76 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// EnvConfig configures a module serving the metrics found in an environment
+// variable of exporter_exporter, in text exposition format.
+type EnvConfig struct {
+	EnvVar string                 `yaml:"env_var"`
+	XXX    map[string]interface{} `yaml:",inline"`
+
+	mcfg *ModuleConfig
+}
+
+func (c *EnvConfig) check() error {
+	if len(c.XXX) != 0 {
+		return fmt.Errorf("Unknown env module configuration fields: %v", c.XXX)
+	}
+	if c.EnvVar == "" {
+		return fmt.Errorf("env_var argument for env module is mandatory")
+	}
+	return nil
+}
+
+func (c EnvConfig) GatherWithContext(ctx context.Context, r *http.Request) prometheus.GathererFunc {
+	return func() ([]*dto.MetricFamily, error) {
+		dat, ok := os.LookupEnv(c.EnvVar)
+		if !ok {
+			log.Warnf("Env module %v failed to read environment variable %v, it is not set", c.mcfg.name, c.EnvVar)
+			moduleReadErrorCount.WithLabelValues(c.mcfg.name).Inc()
+			return nil, fmt.Errorf("environment variable %v is not set", c.EnvVar)
+		}
+
+		var prsr expfmt.TextParser
+		mfs, err := prsr.TextToMetricFamilies(strings.NewReader(dat))
+		if err != nil {
+			proxyMalformedCount.WithLabelValues(c.mcfg.name).Inc()
+			c.mcfg.parseFailed()
+			return nil, err
+		}
+		result := make([]*dto.MetricFamily, 0, len(mfs))
+		for _, mf := range mfs {
+			result = append(result, mf)
+		}
+		return c.mcfg.postProcess(ctx, result)
+	}
+}
+
+func (c EnvConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	g := c.GatherWithContext(ctx, r)
+	serveGatherer(w, r, recoverGatherer(c.mcfg.name, g))
+}
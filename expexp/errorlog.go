@@ -0,0 +1,218 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var moduleLastError = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "expexp_module_last_error",
+		Help: "Set to 1 with the kind of error of the latest scrape of a module as label, absent while it succeeds",
+	},
+	[]string{"module", "error"},
+)
+
+const (
+	// errorHistorySize is the number of failed scrapes kept per module.
+	errorHistorySize = 20
+	// maxErrorMessage bounds the part of an error response kept as its
+	// message.
+	maxErrorMessage = 1024
+)
+
+// moduleError describes a failed scrape of a module.
+type moduleError struct {
+	Time    time.Time `json:"time"`
+	Status  int       `json:"status"`
+	Reason  string    `json:"reason"`
+	Message string    `json:"message"`
+}
+
+// errorHistory is a ring buffer of the latest failed scrapes of a module.
+type errorHistory struct {
+	sync.Mutex
+	entries []moduleError
+	next    int
+	// kind is the error label of the module in expexp_module_last_error,
+	// empty while it succeeds.
+	kind string
+}
+
+func (h *errorHistory) add(e moduleError) {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.entries) < errorHistorySize {
+		h.entries = append(h.entries, e)
+		return
+	}
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % errorHistorySize
+}
+
+// latest returns the recorded errors, newest first.
+func (h *errorHistory) latest() []moduleError {
+	h.Lock()
+	defer h.Unlock()
+	res := make([]moduleError, 0, len(h.entries))
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		res = append(res, h.entries[(h.next+i)%len(h.entries)])
+	}
+	return res
+}
+
+// errorReason classifies a failed scrape by its status, the way the module
+// methods report their failures: 504 for timeouts, 502 for unreachable
+// upstreams, 503 for modules refusing scrapes and 500 for anything else.
+func errorReason(status int) string {
+	switch {
+	case status == 0:
+		return "aborted"
+	case status == http.StatusGatewayTimeout:
+		return "timeout"
+	case status == http.StatusBadGateway:
+		return "upstream"
+	case status == http.StatusServiceUnavailable:
+		return "unavailable"
+	case status >= 500:
+		return "error"
+	case status >= 400:
+		return "rejected"
+	}
+	return "status"
+}
+
+// setKind replaces the expexp_module_last_error series of module name with
+// one for kind, or removes it if kind is empty.
+func (h *errorHistory) setKind(name, kind string) {
+	h.Lock()
+	defer h.Unlock()
+	if kind == h.kind {
+		return
+	}
+	if h.kind != "" {
+		moduleLastError.DeleteLabelValues(name, h.kind)
+	}
+	if kind != "" {
+		moduleLastError.WithLabelValues(name, kind).Set(1)
+	}
+	h.kind = kind
+}
+
+// errorKinds maps parts of error messages to the error labels of
+// expexp_module_last_error, the first match wins.
+var errorKinds = []struct{ match, kind string }{
+	{"text format parsing error", "unparsable metrics"},
+	{"connection refused", "connection refused"},
+	{"no such host", "unknown host"},
+	{"no such file or directory", "not found"},
+	{"permission denied", "permission denied"},
+	{"is not set", "not found"},
+	{"exit status", "command failed"},
+	{"post_transform", "post transform failed"},
+	{"buffer_max_bytes", "response too large"},
+	{"oauth2", "oauth2 token"},
+	{"deadline exceeded", "timeout"},
+}
+
+// errorKind maps a failed scrape to one of a few error labels, from its
+// message where known, from its status otherwise, so the label values stay
+// few and free of secrets.
+func errorKind(status int, msg string) string {
+	msg = strings.ToLower(msg)
+	for _, k := range errorKinds {
+		if strings.Contains(msg, k.match) {
+			return k.kind
+		}
+	}
+	return errorReason(status)
+}
+
+var (
+	secretParam    = regexp.MustCompile(`(?i)((?:token|secret|password|passwd|key|auth)[a-z_-]*=)[^&\s"']+`)
+	secretUserinfo = regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`)
+)
+
+// redactSecrets removes the secrets of the module from msg, as well as
+// passwords in URLs and secret looking query parameters.
+func (m ModuleConfig) redactSecrets(msg string) string {
+	secrets := []string{m.HTTP.BasicAuthPassword}
+	if m.HTTP.OAuth2 != nil {
+		secrets = append(secrets, m.HTTP.OAuth2.ClientSecret)
+	}
+	for _, s := range secrets {
+		if s != "" {
+			msg = strings.ReplaceAll(msg, s, "<redacted>")
+		}
+	}
+	msg = secretParam.ReplaceAllString(msg, "${1}<redacted>")
+	return secretUserinfo.ReplaceAllString(msg, "${1}<redacted>@")
+}
+
+// recordError adds the failed scrape recorded by sr to the error history
+// of m, and sets expexp_module_last_error.
+func (m ModuleConfig) recordError(sr *statusRecorder) {
+	if m.state == nil {
+		return
+	}
+	msg := strings.TrimSpace(string(sr.errMsg))
+	m.state.errors.add(moduleError{
+		Time:    clk.Now(),
+		Status:  sr.status,
+		Reason:  errorReason(sr.status),
+		Message: m.redactSecrets(msg),
+	})
+	m.state.errors.setKind(m.name, errorKind(sr.status, msg))
+}
+
+// clearError removes the expexp_module_last_error series of m after a
+// successful scrape.
+func (m ModuleConfig) clearError() {
+	if m.state != nil {
+		m.state.errors.setKind(m.name, "")
+	}
+}
+
+// serveErrors responds with the error history of the module named in the
+// path, /modules/<name>/errors, as JSON.
+func (cfg *Config) serveErrors(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/modules/")
+	if !strings.HasSuffix(name, "/errors") {
+		http.NotFound(w, r)
+		return
+	}
+	name = strings.TrimSuffix(name, "/errors")
+	m, ok := cfg.Modules[name]
+	if !ok || !m.reachableFrom(r) {
+		http.Error(w, "unknown module "+name, http.StatusNotFound)
+		return
+	}
+	var errs []moduleError
+	if m.state != nil {
+		errs = m.state.errors.latest()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(errs); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,90 @@
+package expexp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestErrorHistory(t *testing.T) {
+	withFakeClock(t)
+	m := &ModuleConfig{
+		Method: "http",
+		HTTP:   HTTPConfig{Port: 1, BasicAuthUsername: "u", BasicAuthPassword: "hunter2"},
+	}
+	if err := CheckModuleConfig("failing", m); err != nil {
+		t.Fatalf("Failed to check module config: %v", err)
+	}
+	for i := 0; i < errorHistorySize+2; i++ {
+		m.recordError(&statusRecorder{
+			status: http.StatusBadGateway,
+			errMsg: []byte(fmt.Sprintf("try %d: hunter2 at http://u:pw@host/?access_token=abc&x=1", i)),
+		})
+	}
+
+	cfg := &Config{Modules: map[string]*ModuleConfig{"failing": m}}
+	rr := httptest.NewRecorder()
+	cfg.serveErrors(rr, httptest.NewRequest("GET", "/modules/failing/errors", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Bad response status %d", rr.Code)
+	}
+	var errs []moduleError
+	if err := json.Unmarshal(rr.Body.Bytes(), &errs); err != nil {
+		t.Fatalf("Failed to decode errors: %v", err)
+	}
+	if len(errs) != errorHistorySize {
+		t.Fatalf("expected %d errors, got %d", errorHistorySize, len(errs))
+	}
+	want := fmt.Sprintf("try %d: <redacted> at http://u:<redacted>@host/?access_token=<redacted>&x=1", errorHistorySize+1)
+	if errs[0].Message != want || errs[0].Reason != "upstream" {
+		t.Errorf("expected the newest error to be %q, got %+v", want, errs[0])
+	}
+	if want := "try 2:"; errs[len(errs)-1].Message[:len(want)] != want {
+		t.Errorf("expected the oldest kept error to be %q, got %+v", want, errs[len(errs)-1])
+	}
+
+	rr = httptest.NewRecorder()
+	cfg.serveErrors(rr, httptest.NewRequest("GET", "/modules/other/errors", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for an unknown module, got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestLastError(t *testing.T) {
+	withFakeClock(t)
+	path := filepath.Join(t.TempDir(), "m.prom")
+	emit := false
+	m := &ModuleConfig{Method: "file", File: FileConfig{Path: path, EmitMtime: &emit}}
+	if err := CheckModuleConfig("last_error", m); err != nil {
+		t.Fatalf("Failed to check module config: %v", err)
+	}
+	scrape := func(content string) {
+		if content == "" {
+			os.Remove(path)
+		} else if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/proxy?module=last_error", nil))
+	}
+	scrape("")
+	if got := testutil.ToFloat64(moduleLastError.WithLabelValues("last_error", "not found")); got != 1 {
+		t.Errorf("expected the missing file to set the not found error, got %v", got)
+	}
+	scrape("m{ 1\n")
+	if got := testutil.ToFloat64(moduleLastError.WithLabelValues("last_error", "unparsable metrics")); got != 1 {
+		t.Errorf("expected the malformed file to set the unparsable metrics error, got %v", got)
+	}
+	if moduleLastError.DeleteLabelValues("last_error", "not found") {
+		t.Errorf("expected the previous error series to be removed")
+	}
+	scrape("m 1\n")
+	if moduleLastError.DeleteLabelValues("last_error", "unparsable metrics") || m.state.errors.kind != "" {
+		t.Errorf("expected the last error to be cleared by a successful scrape")
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	cmdStartsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_command_starts_total",
+			Help: "Counts of command starts",
+		},
+		[]string{"module"},
+	)
+	cmdFailsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_command_fails_total",
+			Help: "Count of commands with non-zero exits",
+		},
+		[]string{"module"},
+	)
+)
+
+// commandWaitDelay bounds how long a finished or killed command is waited for
+// while processes it started still hold its output open.
+const commandWaitDelay = 5 * time.Second
+
+// newCommand prepares command to be run with the given arguments and
+// environment, killing it once ctx is done.
+func newCommand(ctx context.Context, command string, args []string, env map[string]string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, command)
+	cmd.WaitDelay = commandWaitDelay
+	cmd.Args = append(cmd.Args, args...)
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+	return cmd
+}
+
+// runCommand runs cmd, returning the context error as soon as ctx is done
+// rather than waiting for the killed command to be reaped.
+//
+// The command is run by a separate goroutine sending its single result to a
+// buffered channel, so it never blocks on a caller that has already returned.
+// It exits once the command is reaped, which happens at most commandWaitDelay
+// after the command exits or is killed because ctx is done.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- cmd.Run()
+		close(errc)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CheckCommands verifies that the commands of all exec and stream modules
+// can be found and are executable, returning an error for each module
+// failing the check. Exec modules with lazy set are skipped, for commands
+// which are only created after the configuration is loaded.
+func (c *Config) CheckCommands() []error {
+	names := make([]string, 0, len(c.Modules))
+	for name := range c.Modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		mcfg := c.Modules[name]
+		var command string
+		switch {
+		case mcfg.Method == "exec" && !mcfg.Exec.Lazy:
+			command = mcfg.Exec.Command
+		case mcfg.Method == "stream":
+			command = mcfg.Stream.Command
+		default:
+			continue
+		}
+		if _, err := exec.LookPath(command); err != nil {
+			errs = append(errs, fmt.Errorf("%s module %s, %w", mcfg.Method, name, err))
+		}
+	}
+	return errs
+}
+
+func (c ExecConfig) GatherWithContext(ctx context.Context, r *http.Request) prometheus.GathererFunc {
+	return func() ([]*dto.MetricFamily, error) {
+		var out bytes.Buffer
+
+		cmd := newCommand(ctx, c.Command, c.Args, c.Env)
+		uargs, ok := r.URL.Query()["args"]
+		if ok {
+			cmd.Args = append(cmd.Args, uargs...)
+		}
+
+		cmd.Stdout = &out
+		cmd.Stderr = os.Stderr
+
+		cmdStartsCount.WithLabelValues(c.mcfg.name).Inc()
+		err := runCommand(ctx, cmd)
+		if err != nil {
+			log.Warnf("Command module %v failed %+v", c.mcfg.name, err)
+			cmdFailsCount.WithLabelValues(c.mcfg.name).Inc()
+			moduleReadErrorCount.WithLabelValues(c.mcfg.name).Inc()
+			if err == context.DeadlineExceeded {
+				proxyTimeoutCount.WithLabelValues(c.mcfg.name).Inc()
+			}
+			return nil, err
+		}
+		var prsr expfmt.TextParser
+
+		var result []*dto.MetricFamily
+		mfs, err := prsr.TextToMetricFamilies(&out)
+		if err != nil {
+			proxyMalformedCount.WithLabelValues(c.mcfg.name).Inc()
+			c.mcfg.parseFailed()
+			return nil, err
+		}
+		for _, mf := range mfs {
+			result = append(result, mf)
+		}
+		return c.mcfg.postProcess(ctx, result)
+	}
+}
+
+func (c ExecConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	g := c.GatherWithContext(ctx, r)
+	serveGatherer(w, r, recoverGatherer(c.mcfg.name, g))
+}
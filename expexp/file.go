@@ -0,0 +1,329 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	fileStartsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_command_starts_total",
+			Help: "Counts of command starts",
+		},
+		[]string{"module"},
+	)
+	fileFailsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_command_fails_total",
+			Help: "Count of commands with non-zero exits",
+		},
+		[]string{"module"},
+	)
+	fileFutureMtimeCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_file_future_mtime_errors_total",
+			Help: "Counts of scrapes failed because the file modification time is in the future",
+		},
+		[]string{"module"},
+	)
+	fileBytesReadCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_file_bytes_read_total",
+			Help: "Counts of bytes read from the files of file modules",
+		},
+		[]string{"module"},
+	)
+)
+
+func readFileWithDeadline(path string, t time.Time) ([]byte, time.Time, error) {
+	f, err := os.Open(path)
+	mtime := time.Time{}
+	if err != nil {
+		return nil, mtime, err
+	}
+	defer f.Close()
+	f.SetDeadline(t)
+
+	if info, err := f.Stat(); err == nil {
+		if info.Mode().IsRegular() {
+			mtime = info.ModTime()
+		}
+	}
+	data, err := io.ReadAll(f)
+	return data, mtime, err
+}
+
+var (
+	mtimeName = "expexp_file_mtime_timestamp"
+	mtimeHelp = "Time of modification of parsed file"
+	mtimeType = dto.MetricType_GAUGE
+	mtimeLabelModule = "module"
+	mtimeLabelPath   = "path"
+)
+
+var (
+	staleName = "expexp_file_stale_seconds"
+	staleHelp = "Age of the last successful parse served while the file is missing"
+)
+
+// lastResult keeps the last successfully parsed content of a file module, so
+// it can be served while the file is briefly absent during rotation.
+type lastResult struct {
+	sync.Mutex
+	mfs  []*dto.MetricFamily
+	when time.Time
+}
+
+func (l *lastResult) store(mfs []*dto.MetricFamily) {
+	l.Lock()
+	defer l.Unlock()
+	l.mfs = cloneFamilies(mfs)
+	l.when = clk.Now()
+}
+
+// load returns a copy of the stored result and its age, if there is one not
+// older than grace.
+func (l *lastResult) load(grace time.Duration) ([]*dto.MetricFamily, time.Duration, bool) {
+	l.Lock()
+	defer l.Unlock()
+	age := clk.Now().Sub(l.when)
+	if l.mfs == nil || age > grace {
+		return nil, 0, false
+	}
+	return cloneFamilies(l.mfs), age, true
+}
+
+func cloneFamilies(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	res := make([]*dto.MetricFamily, len(mfs))
+	for i, mf := range mfs {
+		res[i] = proto.Clone(mf).(*dto.MetricFamily)
+	}
+	return res
+}
+
+// stampMtime reports whether the samples of mf should get the file mtime as
+// their timestamp when UseMtime is set. By default every family is stamped,
+// mtime_types restricts stamping to the listed metric types, and
+// mtime_skip_created / mtime_skip_info exclude the OpenMetrics style
+// "_created" and "_info" families, which carry their own time semantics.
+func (c FileConfig) stampMtime(mf *dto.MetricFamily) bool {
+	if c.mtimeTypes != nil && !c.mtimeTypes[mf.GetType()] {
+		return false
+	}
+	if c.MtimeSkipCreated && strings.HasSuffix(mf.GetName(), "_created") {
+		return false
+	}
+	if c.MtimeSkipInfo && strings.HasSuffix(mf.GetName(), "_info") {
+		return false
+	}
+	return true
+}
+
+// fileReadResult is the outcome of reading the file of a file module.
+type fileReadResult struct {
+	dat   []byte
+	mtime time.Time
+	err   error
+}
+
+var presenceHelp = "Whether the file exists"
+
+// gatherPresence reports whether the file exists rather than serving its
+// content. Only errors other than the file not existing fail the scrape.
+func (c FileConfig) gatherPresence(ctx context.Context) ([]*dto.MetricFamily, error) {
+	present, mtime := 1.0, time.Time{}
+	info, err := os.Stat(c.Path)
+	switch {
+	case os.IsNotExist(err):
+		present = 0
+	case err != nil:
+		log.Warnf("File module %v failed to stat file %v, %+v", c.mcfg.name, c.Path, err)
+		moduleReadErrorCount.WithLabelValues(c.mcfg.name).Inc()
+		return nil, err
+	case info.Mode().IsRegular():
+		mtime = info.ModTime()
+	}
+
+	result, err := c.mcfg.postProcess(ctx, []*dto.MetricFamily{c.gauge(&c.PresenceMetric, &presenceHelp, present)})
+	if err != nil {
+		return nil, err
+	}
+	if !mtime.IsZero() && (c.EmitMtime == nil || *c.EmitMtime) {
+		result = append(result, c.gauge(&mtimeName, &mtimeHelp, float64(mtime.Unix())))
+	}
+	return result, nil
+}
+
+func (c FileConfig) GatherWithContext(ctx context.Context, r *http.Request) prometheus.GathererFunc {
+	return func() ([]*dto.MetricFamily, error) {
+		if c.PresenceMetric != "" {
+			return c.gatherPresence(ctx)
+		}
+
+		// The file is read by a separate goroutine, so the scrape can give
+		// up once ctx is done even where the OS does not enforce the
+		// deadline on the file. The goroutine sends exactly one result and
+		// exits. As the channel is buffered, that send never blocks, also
+		// when nobody receives any more after ctx is done.
+		resc := make(chan fileReadResult, 1)
+		go func() {
+			// File deadlines are enforced by the OS, so they have to be
+			// absolute wall clock times.
+			deadline := time.Now().Add(remaining(ctx, time.Minute*5))
+			var res fileReadResult
+			res.dat, res.mtime, res.err = readFileWithDeadline(c.Path, deadline)
+			fileBytesReadCount.WithLabelValues(c.mcfg.name).Add(float64(len(res.dat)))
+			resc <- res
+		}()
+
+		var res fileReadResult
+		select {
+		case res = <-resc:
+		case <-ctx.Done():
+			res.err = ctx.Err()
+		}
+
+		err := res.err
+		if err != nil && os.IsNotExist(err) && c.rotation != nil {
+			if mfs, age, ok := c.rotation.load(c.RotationGrace); ok {
+				log.Debugf("File module %v serving last result from %v ago, %v is missing", c.mcfg.name, age, c.Path)
+				return append(mfs, c.gauge(&staleName, &staleHelp, age.Seconds())), nil
+			}
+		}
+		if err != nil {
+			log.Warnf("File module %v failed to read file %v, %+v", c.mcfg.name, c.Path, err)
+			fileFailsCount.WithLabelValues(c.mcfg.name).Inc()
+			moduleReadErrorCount.WithLabelValues(c.mcfg.name).Inc()
+			if err == context.DeadlineExceeded || errors.Is(err, os.ErrDeadlineExceeded) {
+				proxyTimeoutCount.WithLabelValues(c.mcfg.name).Inc()
+			}
+			return nil, err
+		}
+		dat, mtime := res.dat, res.mtime
+		if c.RejectFutureMtime && mtime.After(clk.Now().Add(c.FutureMtimeTolerance)) {
+			log.Warnf("File module %v file %v has modification time %v in the future", c.mcfg.name, c.Path, mtime)
+			fileFutureMtimeCount.WithLabelValues(c.mcfg.name).Inc()
+			return nil, fmt.Errorf("modification time %v of %v is in the future", mtime, c.Path)
+		}
+		var prsr expfmt.TextParser
+
+		var mtimeBuf *int64 = nil
+		if ! mtime.IsZero() {
+			mtimeBuf = new(int64)
+			*mtimeBuf = mtime.UnixMilli()
+		}
+
+		var result []*dto.MetricFamily
+		mfs, err := prsr.TextToMetricFamilies(bytes.NewReader(dat))
+		if err != nil {
+			proxyMalformedCount.WithLabelValues(c.mcfg.name).Inc()
+			c.mcfg.parseFailed()
+			return nil, err
+		}
+		for _, mf := range mfs {
+			if c.UseMtime && mtimeBuf != nil && c.stampMtime(mf) {
+				for _, m := range mf.GetMetric() {
+					if (m.TimestampMs == nil) {
+						m.TimestampMs = mtimeBuf
+					}
+				}
+			}
+			result = append(result, mf)
+		}
+		if result, err = c.mcfg.postProcess(ctx, result); err != nil {
+			return nil, err
+		}
+		if !mtime.IsZero() && (c.EmitMtime == nil || *c.EmitMtime) {
+			result = append(result, c.gauge(&mtimeName, &mtimeHelp, float64(mtime.Unix())))
+		}
+		if c.rotation != nil {
+			c.rotation.store(result)
+		}
+		return result, nil
+	}
+}
+
+// gauge builds a single sample gauge family labelled with the module name and
+// file path.
+func (c FileConfig) gauge(name, help *string, v float64) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: name,
+		Help: help,
+		Type: &mtimeType,
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{
+				{Name: &mtimeLabelModule, Value: &c.mcfg.name},
+				{Name: &mtimeLabelPath, Value: &c.Path},
+			},
+			Gauge: &dto.Gauge{Value: &v},
+		}},
+	}
+}
+
+// contentTypeWriter replaces the Content-Type of successful responses.
+type contentTypeWriter struct {
+	http.ResponseWriter
+	contentType string
+	written     bool
+}
+
+func (w *contentTypeWriter) WriteHeader(status int) {
+	if !w.written && status == http.StatusOK {
+		w.Header().Set("Content-Type", w.contentType)
+	}
+	w.written = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *contentTypeWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *contentTypeWriter) Flush() {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c FileConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.ContentType != "" {
+		w = &contentTypeWriter{ResponseWriter: w, contentType: c.ContentType}
+	}
+	ctx := r.Context()
+	g := c.GatherWithContext(ctx, r)
+	serveGatherer(w, r, recoverGatherer(c.mcfg.name, g))
+}
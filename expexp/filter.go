@@ -0,0 +1,129 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+var (
+	droppedFamiliesCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_dropped_families_total",
+			Help: "Counts of metric families dropped by module filters",
+		},
+		[]string{"module"},
+	)
+)
+
+// hasPostProcess reports whether the module has any filters configured that
+// need the parsed metric families.
+func (cfg ModuleConfig) hasPostProcess() bool {
+	return cfg.DuplicateLabels != "" || cfg.metricAllow != nil || cfg.labelKeep != nil || cfg.MaxHistogramBuckets > 0 || cfg.PostTransform != nil || cfg.ScrapeSamples || cfg.ScrapeTime || cfg.MonotonicCounters
+}
+
+// postProcess applies the module filters to the metric families parsed from
+// the module's source.
+func (cfg ModuleConfig) postProcess(ctx context.Context, mfs []*dto.MetricFamily) ([]*dto.MetricFamily, error) {
+	if cfg.DuplicateLabels != "" {
+		if err := dedupLabels(mfs, cfg.DuplicateLabels); err != nil {
+			cfg.parseFailed()
+			return nil, err
+		}
+	}
+	if cfg.metricAllow != nil {
+		res := mfs[:0]
+		for _, mf := range mfs {
+			if !cfg.metricAllow[mf.GetName()] {
+				droppedFamiliesCount.WithLabelValues(cfg.name).Inc()
+				continue
+			}
+			res = append(res, mf)
+		}
+		mfs = res
+	}
+	if cfg.labelKeep != nil {
+		if err := keepLabels(mfs, cfg.labelKeep, cfg.LabelKeepCollisions); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.MaxHistogramBuckets > 0 {
+		var err error
+		if mfs, err = cfg.limitHistogramBuckets(mfs); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PostTransform != nil {
+		var err error
+		if mfs, err = cfg.PostTransform.apply(ctx, cfg.name, mfs); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.monotonic != nil {
+		cfg.monotonic.apply(cfg.name, mfs)
+	}
+	if cfg.ScrapeSamples {
+		mfs = append(mfs, scrapeSamples(cfg.name, mfs))
+	}
+	if cfg.ScrapeTime {
+		mfs = append(mfs, upstreamScrapeTime(ctx, cfg.name))
+	}
+	return mfs, nil
+}
+
+var (
+	scrapeTimeName = "expexp_scrape_time_seconds"
+	scrapeTimeHelp = "Time of the upstream scrape that produced the response, in seconds since the epoch"
+)
+
+type upstreamScrapeKey struct{}
+
+// upstreamScrapeTime returns a family with the time the upstream scrape in
+// ctx started, added to the response of module name when ScrapeTime is set.
+// Responses served again from the cache, min_interval or a freshness probe
+// keep the time of the scrape that produced them.
+func upstreamScrapeTime(ctx context.Context, name string) *dto.MetricFamily {
+	t, ok := ctx.Value(upstreamScrapeKey{}).(time.Time)
+	if !ok {
+		t = clk.Now()
+	}
+	v := float64(t.UnixNano()) / 1e9
+	return &dto.MetricFamily{
+		Name: &scrapeTimeName,
+		Help: &scrapeTimeHelp,
+		Type: &mtimeType,
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{{Name: &mtimeLabelModule, Value: &name}},
+			Gauge: &dto.Gauge{Value: &v},
+		}},
+	}
+}
+
+// encodeFamilies serializes metric families in the given format.
+func encodeFamilies(format expfmt.Format, mfs []*dto.MetricFamily) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, format)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,235 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	freshnessProbesCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_freshness_probes_total",
+			Help: "Counts of freshness probes of http modules by result: unchanged, changed or error",
+		},
+		[]string{"module", "result"},
+	)
+)
+
+// defaultFreshnessMaxAge bounds how long a response is served again on an
+// unchanged probe unless max_age is set.
+const defaultFreshnessMaxAge = time.Hour
+
+// FreshnessProbeConfig configures a cheap request made to the upstream of
+// an http module before every scrape. While the ETag, or otherwise the
+// Last-Modified header, of its response stays the same, the response of the
+// previous scrape is served again instead of scraping the upstream.
+type FreshnessProbeConfig struct {
+	Path   string                 `yaml:"path"`    // the module path
+	Method string                 `yaml:"method"`  // HEAD
+	MaxAge time.Duration          `yaml:"max_age"` // 1h
+	XXX    map[string]interface{} `yaml:",inline"`
+
+	director  func(*http.Request)
+	responses *freshResponses
+}
+
+func (p *FreshnessProbeConfig) check(cfg *ModuleConfig) error {
+	if len(p.XXX) != 0 {
+		return fmt.Errorf("Unknown freshness_probe configuration fields: %v", p.XXX)
+	}
+	if p.Method == "" {
+		p.Method = http.MethodHead
+	}
+	if p.Method != http.MethodHead && p.Method != http.MethodGet {
+		return fmt.Errorf("freshness_probe method must be HEAD or GET")
+	}
+	if p.MaxAge < 0 {
+		return fmt.Errorf("freshness_probe max_age must not be negative")
+	}
+	if p.MaxAge == 0 {
+		p.MaxAge = defaultFreshnessMaxAge
+	}
+	if p.Path == "" {
+		p.Path = cfg.HTTP.Path
+		if p.Path == "" {
+			p.Path = cfg.HTTP.Paths[0]
+		}
+	}
+	dirFunc, err := cfg.getReverseProxyDirectorFunc(p.Path)
+	if err != nil {
+		return err
+	}
+	p.director = dirFunc
+	p.responses = newFreshResponses(cfg.CacheMaxEntries, p.MaxAge)
+	return nil
+}
+
+type freshResponse struct {
+	key       string
+	validator string
+	resp      *bufferedResponse
+	when      time.Time
+}
+
+// freshResponses keeps the latest successful response of a module for each
+// cache key, with the probe validator it was obtained under. Like
+// responseCache it holds at most maxEntries responses, evicting the least
+// recently used ones, and drops responses older than maxAge when storing
+// and every maxAge while the configuration runs.
+type freshResponses struct {
+	sync.Mutex
+	maxEntries int
+	maxAge     time.Duration
+	lastSweep  time.Time
+	lru        *list.List
+	entries    map[string]*list.Element
+}
+
+func newFreshResponses(maxEntries int, maxAge time.Duration) *freshResponses {
+	return &freshResponses{
+		maxEntries: maxEntries,
+		maxAge:     maxAge,
+		lastSweep:  clk.Now(),
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+func (f *freshResponses) get(key, validator string) *bufferedResponse {
+	f.Lock()
+	defer f.Unlock()
+	el, ok := f.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*freshResponse)
+	if e.validator != validator || clk.Now().Sub(e.when) > f.maxAge {
+		return nil
+	}
+	f.lru.MoveToFront(el)
+	return e.resp
+}
+
+func (f *freshResponses) store(key, validator string, resp *bufferedResponse) {
+	f.Lock()
+	defer f.Unlock()
+	el, ok := f.entries[key]
+	if resp.status != http.StatusOK {
+		if ok {
+			f.remove(el)
+		}
+		return
+	}
+	now := clk.Now()
+	e := &freshResponse{key: key, validator: validator, resp: resp, when: now}
+	if ok {
+		el.Value = e
+		f.lru.MoveToFront(el)
+	} else {
+		f.entries[key] = f.lru.PushFront(e)
+	}
+
+	// Responses nobody asks for any more are dropped here and by expire,
+	// looking for them at most once per maxAge.
+	if now.Sub(f.lastSweep) >= f.maxAge {
+		f.sweep(now)
+	}
+	for f.maxEntries > 0 && f.lru.Len() > f.maxEntries {
+		f.remove(f.lru.Back())
+	}
+}
+
+// expire drops the responses older than maxAge.
+func (f *freshResponses) expire() {
+	f.Lock()
+	defer f.Unlock()
+	f.sweep(clk.Now())
+}
+
+// sweep drops the responses older than maxAge at now. f must be locked.
+func (f *freshResponses) sweep(now time.Time) {
+	f.lastSweep = now
+	for el := f.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if now.Sub(el.Value.(*freshResponse).when) > f.maxAge {
+			f.remove(el)
+		}
+		el = prev
+	}
+}
+
+func (f *freshResponses) remove(el *list.Element) {
+	f.lru.Remove(el)
+	delete(f.entries, el.Value.(*freshResponse).key)
+}
+
+// probe runs the freshness probe for r and returns the validator of its
+// response.
+func (c HTTPConfig) probe(r *http.Request) (string, error) {
+	p := c.FreshnessProbe
+	req, err := http.NewRequestWithContext(r.Context(), p.Method, r.URL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	p.director(req)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("probe returned status %v", resp.Status)
+	}
+	if v := resp.Header.Get("ETag"); v != "" {
+		return v, nil
+	}
+	if v := resp.Header.Get("Last-Modified"); v != "" {
+		return v, nil
+	}
+	return "", fmt.Errorf("probe response has neither ETag nor Last-Modified header")
+}
+
+// serveProbed serves r with scrape, unless the freshness probe shows that
+// the upstream did not change since the previous response. A failed probe
+// falls back to scraping.
+func (c HTTPConfig) serveProbed(w http.ResponseWriter, r *http.Request, scrape func(http.ResponseWriter, *http.Request)) {
+	validator, err := c.probe(r)
+	if err != nil {
+		log.Debugf("Freshness probe of module %v failed, scraping, %v", c.mcfg.name, err)
+		freshnessProbesCount.WithLabelValues(c.mcfg.name, "error").Inc()
+		scrape(w, r)
+		return
+	}
+
+	key := cacheKey(r)
+	if resp := c.FreshnessProbe.responses.get(key, validator); resp != nil {
+		freshnessProbesCount.WithLabelValues(c.mcfg.name, "unchanged").Inc()
+		resp.writeTo(w)
+		return
+	}
+	freshnessProbesCount.WithLabelValues(c.mcfg.name, "changed").Inc()
+	resp := newBufferedResponse()
+	scrape(resp, r)
+	c.FreshnessProbe.responses.store(key, validator, resp)
+	resp.writeTo(w)
+}
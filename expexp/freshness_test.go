@@ -0,0 +1,33 @@
+package expexp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFreshResponsesBounded(t *testing.T) {
+	fc := withFakeClock(t)
+	f := newFreshResponses(2, time.Minute)
+	for i := 0; i < 3; i++ {
+		f.store(fmt.Sprintf("k%d", i), "v", newBufferedResponse())
+	}
+	if got := len(f.entries); got != 2 {
+		t.Errorf("expected at most 2 responses, got %d", got)
+	}
+	if f.get("k0", "v") != nil {
+		t.Errorf("expected the least recently used response to be evicted")
+	}
+	if f.get("k2", "v") == nil || f.get("k2", "other") != nil {
+		t.Errorf("expected the newest response for its validator only")
+	}
+
+	fc.Advance(2 * time.Minute)
+	if f.get("k2", "v") != nil {
+		t.Errorf("expected responses older than max_age not to be served")
+	}
+	f.store("k3", "v", newBufferedResponse())
+	if got := len(f.entries); got != 1 {
+		t.Errorf("expected expired responses to be dropped, %d left", got)
+	}
+}
@@ -0,0 +1,490 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	proxyDuration = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name: "expexp_proxy_duration_seconds",
+			Help: "Duration of proxying requests to configured exporters",
+		},
+		[]string{"module"},
+	)
+	moduleQueueWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "expexp_module_queue_wait_seconds",
+			Help:    "Time scrapes of modules waited for a free max_concurrent slot of the module or the global one",
+			Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30},
+		},
+		[]string{"module"},
+	)
+	proxyErrorCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_proxy_errors_total",
+			Help: "Counts of errors",
+		},
+		[]string{"module"},
+	)
+	proxyTimeoutCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_proxy_timeout_errors_total",
+			Help: "Counts of the number of times a proxy timeout occurred",
+		},
+		[]string{"module"},
+	)
+
+	proxyMalformedCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_malformed_content_errors_total",
+			Help: "Counts of unparsable scrape content errors",
+		},
+		[]string{"module"},
+	)
+
+	moduleReadErrorCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_module_read_errors_total",
+			Help: "Counts of failures to obtain content from a module's source",
+		},
+		[]string{"module"},
+	)
+	moduleParseErrorCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_module_parse_errors_total",
+			Help: "Counts of failures to parse content obtained from a module's source",
+		},
+		[]string{"module"},
+	)
+
+	parseCooldownRejectsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_module_parse_cooldown_rejections_total",
+			Help: "Counts of scrapes failed without trying the module during a parse failure cooldown",
+		},
+		[]string{"module"},
+	)
+	parseCooldownUntil = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "expexp_module_parse_cooldown_until_timestamp_seconds",
+			Help: "Time until which scrapes of a module are failed after repeated parse failures",
+		},
+		[]string{"module"},
+	)
+
+	moduleResponseBytesCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_module_response_bytes_total",
+			Help: "Counts of bytes of module responses served to clients",
+		},
+		[]string{"module"},
+	)
+	moduleMaxResponseBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "expexp_module_max_response_bytes",
+			Help: "Largest response size of a module within the last one to two max_response_bytes_window",
+		},
+		[]string{"module"},
+	)
+
+	modulesTotal = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "expexp_modules_total",
+			Help: "Number of configured modules",
+		},
+	)
+	modulesByMethod = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "expexp_modules",
+			Help: "Number of configured modules by method",
+		},
+		[]string{"method"},
+	)
+)
+
+func init() {
+	// register the collector metrics in the default
+	// registry.
+	prometheus.MustRegister(proxyDuration)
+	prometheus.MustRegister(httpRequestsCount)
+	prometheus.MustRegister(moduleQueueWait)
+	prometheus.MustRegister(proxyTimeoutCount)
+	prometheus.MustRegister(proxyErrorCount)
+	prometheus.MustRegister(proxyMalformedCount)
+	prometheus.MustRegister(moduleReadErrorCount)
+	prometheus.MustRegister(moduleParseErrorCount)
+	prometheus.MustRegister(modulePanicsCount)
+	prometheus.MustRegister(parseCooldownRejectsCount)
+	prometheus.MustRegister(parseCooldownUntil)
+	prometheus.MustRegister(droppedFamiliesCount)
+	prometheus.MustRegister(oversizedHistogramsCount)
+	prometheus.MustRegister(postTransformErrorsCount)
+	prometheus.MustRegister(fileFutureMtimeCount)
+	prometheus.MustRegister(fileBytesReadCount)
+	prometheus.MustRegister(mergeConflictCount)
+	prometheus.MustRegister(cacheResponsesCount)
+	prometheus.MustRegister(cacheRefreshesCount)
+	prometheus.MustRegister(cacheEntries)
+	prometheus.MustRegister(cacheRefreshBackoffs)
+	prometheus.MustRegister(minIntervalAge)
+	prometheus.MustRegister(monotonicHeldCount)
+	prometheus.MustRegister(moduleDistinctTargets)
+	prometheus.MustRegister(moduleLastError)
+	prometheus.MustRegister(rateLimitedCount)
+	prometheus.MustRegister(moduleQueueDepth)
+	prometheus.MustRegister(cacheEvictionsCount)
+	prometheus.MustRegister(bufferOverflowsCount)
+	prometheus.MustRegister(connectRetriesCount)
+	prometheus.MustRegister(freshnessProbesCount)
+	prometheus.MustRegister(streamRestartsCount)
+	prometheus.MustRegister(streamOversizedCount)
+	prometheus.MustRegister(cmdStartsCount)
+	prometheus.MustRegister(cmdFailsCount)
+	prometheus.MustRegister(moduleResponseBytesCount)
+	prometheus.MustRegister(moduleMaxResponseBytes)
+	prometheus.MustRegister(tlsCertExpiry)
+	prometheus.MustRegister(modulesTotal)
+	prometheus.MustRegister(modulesByMethod)
+}
+
+// NewHandler returns a handler serving the modules of cfg at proxyPath, with
+// the module named by the "module" query parameter, the readiness gate at
+// /-/ready, the health weight at /-/health/weight, the recent errors of each
+// module at /modules/<name>/errors and a listing of all modules on any other
+// path.
+func NewHandler(cfg *Config, proxyPath string) http.Handler {
+	cfg.setModuleMetrics()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(proxyPath, cfg.doProxy)
+	if cfg.ready == nil {
+		cfg.ready = newReadiness(cfg)
+	}
+	mux.Handle("/-/ready", cfg.ready)
+	mux.Handle("/-/health/weight", healthWeight{cfg})
+	mux.Handle("/modules/", cfg.Admin.restrict(http.HandlerFunc(cfg.serveErrors)))
+	mux.HandleFunc("/", cfg.listModules)
+	return mux
+}
+
+type listenerKey struct{}
+
+// WithListener returns a copy of ctx marking requests made with it as
+// received on the listener called name. Modules restricted to some listeners
+// are only served to requests marked with one of them.
+func WithListener(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, listenerKey{}, name)
+}
+
+// reachableFrom reports whether module m may be served to r.
+func (m *ModuleConfig) reachableFrom(r *http.Request) bool {
+	if len(m.Listeners) == 0 {
+		return true
+	}
+	name, _ := r.Context().Value(listenerKey{}).(string)
+	for _, l := range m.Listeners {
+		if l == name {
+			return true
+		}
+	}
+	return false
+}
+
+// reachableModules returns the modules that may be served to r.
+func (cfg *Config) reachableModules(r *http.Request) map[string]*ModuleConfig {
+	res := make(map[string]*ModuleConfig, len(cfg.Modules))
+	for name, m := range cfg.Modules {
+		if m.reachableFrom(r) {
+			res[name] = m
+		}
+	}
+	return res
+}
+
+// CheckListeners verifies that the modules are only restricted to listeners
+// from names.
+func (cfg *Config) CheckListeners(names []string) error {
+	known := make(map[string]bool, len(names))
+	for _, n := range names {
+		known[n] = true
+	}
+	for name, m := range cfg.Modules {
+		for _, l := range m.Listeners {
+			if !known[l] {
+				return fmt.Errorf("module %s refers to unknown listener %s", name, l)
+			}
+		}
+	}
+	return nil
+}
+
+// setModuleMetrics updates the module inventory metrics to reflect cfg.
+func (cfg *Config) setModuleMetrics() {
+	modulesTotal.Set(float64(len(cfg.Modules)))
+	modulesByMethod.Reset()
+	for _, m := range []string{"env", "exec", "file", "health", "http", "sentinel", "stream"} {
+		modulesByMethod.WithLabelValues(m)
+	}
+	for _, m := range cfg.Modules {
+		modulesByMethod.WithLabelValues(m.Method).Inc()
+	}
+}
+
+func (cfg *Config) doProxy(w http.ResponseWriter, r *http.Request) {
+	mod, ok := r.URL.Query()["module"]
+	if !ok {
+		log.Errorf("no module given")
+		http.Error(w, fmt.Sprintf("require parameter module is missing%v\n", mod), http.StatusBadRequest)
+		return
+	}
+
+	log.Debugf("running module %v\n", mod[0])
+
+	var h http.Handler
+	if m, ok := cfg.Modules[mod[0]]; !ok || !m.reachableFrom(r) {
+		proxyErrorCount.WithLabelValues("unknown").Inc()
+		log.Warnf("unknown module requested  %v\n", mod)
+		http.Error(w, fmt.Sprintf("unknown module %v\n", mod), http.StatusNotFound)
+		return
+	} else if _, ok := r.URL.Query()["args"]; ok && cfg.SafeMode && m.Method == "exec" {
+		log.Warnf("refusing arguments for module %v in safe mode", mod[0])
+		http.Error(w, "args are not allowed in safe mode", http.StatusBadRequest)
+		return
+	} else if r.URL.Query().Get("count") == "1" {
+		cfg.Admin.restrict(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveCount(m, w, r)
+		})).ServeHTTP(w, r)
+		return
+	} else {
+		h = m
+	}
+
+	if m := cfg.Modules[mod[0]]; cfg.SafeMode && m.Method == "http" {
+		// Only the configured parameters reach the upstream.
+		log.Debugf("dropping request parameters for module %v in safe mode", mod[0])
+		r = r.Clone(r.Context())
+		r.URL.RawQuery = url.Values{"module": mod[:1]}.Encode()
+	}
+	h.ServeHTTP(w, r)
+}
+
+func (cfg *Config) listModules(w http.ResponseWriter, r *http.Request) {
+	switch r.Header.Get("Accept") {
+	case "application/json":
+		log.Debugf("Listing modules in json")
+		moduleJSON, err := json.Marshal(cfg.reachableModules(r))
+		if err != nil {
+			log.Error(err)
+			http.Error(w, "Failed to produce JSON", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(moduleJSON)
+	default:
+		log.Debugf("Listing modules in html")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		tmpl := template.Must(template.New("modules").Parse(`
+			<h2>Exporters:</h2>
+				<ul>
+					{{range $name, $cfg := .Modules}}
+						<li><a href="/proxy?module={{$name}}">{{$name}}</a></li>
+					{{end}}
+				</ul>`))
+		err := tmpl.Execute(w, struct{ Modules map[string]*ModuleConfig }{cfg.reachableModules(r)})
+		if err != nil {
+			log.Error(err)
+			http.Error(w, "Can't execute the template", http.StatusInternalServerError)
+		}
+	}
+	return
+}
+
+func (m ModuleConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !m.clientCertAllowed(w, r) {
+		return
+	}
+	if !m.rateAllowed(w, r) {
+		return
+	}
+	m.observeTarget(r)
+	if m.forceFormat != "" {
+		r = r.Clone(r.Context())
+		r.Header.Set("Accept", string(m.forceFormat))
+	}
+	sent := &statusRecorder{ResponseWriter: w}
+	w = sent
+	defer func() {
+		moduleResponseBytesCount.WithLabelValues(m.name).Add(float64(sent.bytes))
+	}()
+	if m.FailStatus != 0 {
+		w = &failStatusWriter{ResponseWriter: w, status: m.FailStatus}
+	}
+	if m.MinInterval > 0 {
+		m.serveThrottled(w, r)
+		return
+	}
+	if m.cache != nil {
+		m.serveCached(w, r)
+		return
+	}
+	if m.BufferResponse {
+		m.serveBuffered(r).writeTo(w)
+		return
+	}
+	m.serve(w, r)
+}
+
+// serve runs the module for r.
+func (m ModuleConfig) serve(w http.ResponseWriter, r *http.Request) {
+	st := clk.Now()
+	defer func() {
+		proxyDuration.WithLabelValues(m.name).Observe(float64(clk.Now().Sub(st)) / float64(time.Second))
+	}()
+
+	nr := r
+	if m.ScrapeTime {
+		nr = r.WithContext(context.WithValue(r.Context(), upstreamScrapeKey{}, st))
+	}
+	cancel := func() {}
+	if m.Timeout != 0 {
+		log.Debugf("setting module %v timeout to %v", m.name, m.Timeout)
+
+		var ctx context.Context
+		ctx, cancel = clk.WithTimeout(nr.Context(), m.Timeout)
+		nr = r.WithContext(ctx)
+	}
+	defer cancel()
+
+	if until, ok := m.state.coolingDown(); ok {
+		parseCooldownRejectsCount.WithLabelValues(m.name).Inc()
+		http.Error(w, fmt.Sprintf("Module %v failed to parse repeatedly, not trying it again until %v", m.name, until.Format(time.RFC3339)), http.StatusServiceUnavailable)
+		return
+	}
+
+	release, err := m.state.acquire(nr.Context(), m.name)
+	if err != nil {
+		log.Warnf("Module %v gave up waiting for one of its %d scrape slots, %v", m.name, m.MaxConcurrent, err)
+		http.Error(w, fmt.Sprintf("Module %v has too many concurrent scrapes", m.name), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	release, err = m.sched.acquire(nr.Context(), m.name, m.Weight)
+	if err != nil {
+		log.Warnf("Module %v gave up waiting for one of the global scrape slots, %v", m.name, err)
+		http.Error(w, fmt.Sprintf("Module %v waited too long for a global scrape slot", m.name), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	defer m.state.startScrape()()
+
+	sr := &statusRecorder{ResponseWriter: w}
+	w = sr
+	defer func() {
+		if sr.status == http.StatusOK {
+			m.state.markSucceeded()
+			m.clearError()
+		} else {
+			m.state.markFailed()
+			m.recordError(sr)
+		}
+		if m.MaxResponseBytesWindow > 0 {
+			m.state.observeResponseSize(m.name, m.MaxResponseBytesWindow, sr.bytes)
+		}
+	}()
+
+	switch m.Method {
+	case "exec":
+		m.Exec.mcfg = &m
+		m.Exec.ServeHTTP(w, nr)
+	case "http":
+		m.HTTP.mcfg = &m
+		m.HTTP.ServeHTTP(w, nr)
+	case "file":
+		m.File.mcfg = &m
+		m.File.ServeHTTP(w, nr)
+	case "stream":
+		m.Stream.mcfg = &m
+		m.Stream.ServeHTTP(w, nr)
+	case "env":
+		m.Env.mcfg = &m
+		m.Env.ServeHTTP(w, nr)
+	case "sentinel":
+		serveSentinel(w, nr)
+	case "health":
+		m.serveHealth(w, nr)
+	default:
+		log.Errorf("unknown module method  %v\n", m.Method)
+		proxyErrorCount.WithLabelValues(m.name).Inc()
+		http.Error(w, fmt.Sprintf("unknown module method %v\n", m.Method), http.StatusNotFound)
+		return
+	}
+}
+
+// failStatusWriter replaces the status of failed module responses, those
+// with a 5xx status. If the replacement is a 2xx status, the error message is
+// dropped and the response is left empty.
+type failStatusWriter struct {
+	http.ResponseWriter
+	status int
+
+	written bool
+	discard bool
+}
+
+func (w *failStatusWriter) WriteHeader(status int) {
+	if w.written {
+		return
+	}
+	w.written = true
+	if status >= 500 {
+		status = w.status
+		w.discard = status < 300
+		if w.discard {
+			w.Header().Del("Content-Type")
+			w.Header().Del("X-Content-Type-Options")
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *failStatusWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discard {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *failStatusWriter) Flush() {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.discard {
+		f.Flush()
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// healthCounters are the families of the handler's own metrics that health
+// modules copy for the modules they report on.
+var healthCounters = map[string]bool{
+	"expexp_proxy_errors_total":             true,
+	"expexp_proxy_timeout_errors_total":     true,
+	"expexp_module_read_errors_total":       true,
+	"expexp_module_parse_errors_total":      true,
+	"expexp_malformed_content_errors_total": true,
+}
+
+// healthGauge returns a gauge family with one series per module in names.
+func healthGauge(name, help string, names []string, value func(m string) (float64, bool)) *dto.MetricFamily {
+	mf := &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String(help),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, n := range names {
+		v, ok := value(n)
+		if !ok {
+			continue
+		}
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{Name: proto.String("module"), Value: proto.String(n)}},
+			Gauge: &dto.Gauge{Value: proto.Float64(v)},
+		})
+	}
+	return mf
+}
+
+// moduleLabel returns the value of the module label of m.
+func moduleLabel(m *dto.Metric) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == "module" {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// gatherHealth returns the health of the other modules reachable from r,
+// from the state kept by the handler and its metrics in the default
+// registry.
+func (m ModuleConfig) gatherHealth(r *http.Request) prometheus.GathererFunc {
+	return func() ([]*dto.MetricFamily, error) {
+		if m.all == nil {
+			return nil, fmt.Errorf("health module %v is not part of a checked configuration", m.name)
+		}
+		mods := map[string]*ModuleConfig{}
+		var names []string
+		for name, mod := range m.all.reachableModules(r) {
+			if mod.Method == "health" {
+				continue
+			}
+			mods[name] = mod
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		mfs := []*dto.MetricFamily{
+			healthGauge("expexp_module_up", "Whether the latest scrape of the module succeeded, 0 before the first scrape", names, func(n string) (float64, bool) {
+				s := mods[n].state
+				if s == nil {
+					return 0, false
+				}
+				return float64(atomic.LoadInt32(&s.up)), true
+			}),
+			healthGauge("expexp_module_last_success_timestamp_seconds", "Time of the latest successful scrape of the module", names, func(n string) (float64, bool) {
+				s := mods[n].state
+				if !s.hasSucceeded() {
+					return 0, false
+				}
+				return float64(atomic.LoadInt64(&s.lastSuccess)) / 1e9, true
+			}),
+			healthGauge("expexp_module_in_flight", "Number of scrapes of the module in progress", names, func(n string) (float64, bool) {
+				s := mods[n].state
+				if s == nil {
+					return 0, false
+				}
+				return float64(atomic.LoadInt32(&s.inFlight)), true
+			}),
+		}
+
+		own, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			return nil, err
+		}
+		for _, mf := range own {
+			if !healthCounters[mf.GetName()] {
+				continue
+			}
+			ms := mf.Metric[:0]
+			for _, s := range mf.GetMetric() {
+				if mods[moduleLabel(s)] != nil {
+					ms = append(ms, s)
+				}
+			}
+			mf.Metric = ms
+			mfs = append(mfs, mf)
+		}
+		return m.postProcess(r.Context(), mfs)
+	}
+}
+
+func (m ModuleConfig) serveHealth(w http.ResponseWriter, r *http.Request) {
+	serveGatherer(w, r, recoverGatherer(m.name, m.gatherHealth(r)))
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	oversizedHistogramsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_oversized_histograms_total",
+			Help: "Counts of histograms exceeding max_histogram_buckets, by the action taken",
+		},
+		[]string{"module", "action"},
+	)
+)
+
+// The actions taken on histograms exceeding max_histogram_buckets.
+const (
+	histogramBucketsDrop     = "drop"
+	histogramBucketsCollapse = "collapse"
+	histogramBucketsReject   = "reject"
+)
+
+// collapseBuckets reduces the cumulative buckets bs to n of them, keeping
+// evenly spread upper bounds including the last one. The counts of the kept
+// buckets stay exact.
+func collapseBuckets(bs []*dto.Bucket, n int) []*dto.Bucket {
+	res := make([]*dto.Bucket, 0, n)
+	for i := 1; i <= n; i++ {
+		res = append(res, bs[i*len(bs)/n-1])
+	}
+	return res
+}
+
+// limitHistogramBuckets applies MaxHistogramBuckets to the histograms in mfs.
+func (cfg ModuleConfig) limitHistogramBuckets(mfs []*dto.MetricFamily) ([]*dto.MetricFamily, error) {
+	max := cfg.MaxHistogramBuckets
+	res := mfs[:0]
+	for _, mf := range mfs {
+		if mf.GetType() != dto.MetricType_HISTOGRAM {
+			res = append(res, mf)
+			continue
+		}
+		ms := make([]*dto.Metric, 0, len(mf.GetMetric()))
+		for _, m := range mf.GetMetric() {
+			bs := m.GetHistogram().GetBucket()
+			if len(bs) <= max {
+				ms = append(ms, m)
+				continue
+			}
+			oversizedHistogramsCount.WithLabelValues(cfg.name, cfg.HistogramBucketsAction).Inc()
+			switch cfg.HistogramBucketsAction {
+			case histogramBucketsReject:
+				return nil, fmt.Errorf("histogram %s has %d buckets, more than the maximum of %d", mf.GetName(), len(bs), max)
+			case histogramBucketsCollapse:
+				m.Histogram.Bucket = collapseBuckets(bs, max)
+				ms = append(ms, m)
+			}
+		}
+		// Families left without any series by dropping them are removed
+		// altogether.
+		if len(ms) == 0 && len(mf.GetMetric()) != 0 {
+			continue
+		}
+		mf.Metric = ms
+		res = append(res, mf)
+	}
+	return res, nil
+}
@@ -0,0 +1,533 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// Msg to send in response body when verification of proxied server
+	// response is failed
+	VerificationErrorMsg = "Internal Server Error: " +
+		"Response from proxied server failed verification. " +
+		"See server logs for details"
+)
+
+type VerifyError struct {
+	msg   string
+	cause error
+}
+
+func (e *VerifyError) Error() string { return e.msg + ": " + e.cause.Error() }
+func (e *VerifyError) Unwrap() error { return e.cause }
+
+func (cfg ModuleConfig) getReverseProxyDirectorFunc(path string) (func(*http.Request), error) {
+	base, err := url.Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("http configuration path should be a valid URL path with options, %w", err)
+	}
+
+	cvs := base.Query()
+
+	return func(r *http.Request) {
+		qvs := r.URL.Query()
+		for k, vs := range cvs {
+			for _, v := range vs {
+				qvs.Add(k, v)
+			}
+		}
+		qvs["module"] = qvs["module"][1:]
+
+		shard := ""
+		if cfg.HTTP.ShardParam != "" {
+			shard = qvs.Get(cfg.HTTP.ShardParam)
+			qvs.Del(cfg.HTTP.ShardParam)
+		}
+
+		r.URL.RawQuery = qvs.Encode()
+
+		// Configured headers replace those of the scrape, such as the
+		// Accept-Language or Accept-Charset prometheus sends, so the
+		// upstream never gets both.
+		for k, v := range cfg.HTTP.Headers {
+			r.Header.Set(k, v)
+		}
+		if cfg.HTTP.UpstreamAccept != "" {
+			r.Header.Set("Accept", cfg.HTTP.UpstreamAccept)
+		}
+
+		r.URL.Scheme = cfg.HTTP.Scheme
+		r.URL.Host = net.JoinHostPort(cfg.HTTP.Address, strconv.Itoa(cfg.HTTP.Port))
+		if _, ok := cfg.HTTP.Headers["host"]; ok {
+			r.Host = cfg.HTTP.Headers["host"]
+		}
+		r.URL.Path = base.Path
+		if su, ok := cfg.HTTP.shardURLs[shard]; ok {
+			r.URL.Scheme = su.Scheme
+			r.URL.Host = su.Host
+			if su.Path != "" {
+				r.URL.Path = su.Path
+			}
+		}
+		if cfg.HTTP.BasicAuthUsername != "" && cfg.HTTP.BasicAuthPassword != "" {
+			r.SetBasicAuth(cfg.HTTP.BasicAuthUsername, cfg.HTTP.BasicAuthPassword)
+		}
+	}, nil
+}
+
+func (cfg ModuleConfig) getReverseProxyModifyResponseFunc() func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if cfg.HTTP.BodyTimeout > 0 {
+			resp.Body = withBodyTimeout(resp.Body, cfg.HTTP.BodyTimeout)
+		}
+		if resp.StatusCode != 200 || !(*cfg.HTTP.Verify || cfg.hasPostProcess() || cfg.forceFormat != "") {
+			return nil
+		}
+
+		var (
+			err     error
+			body    bytes.Buffer
+			oldBody = resp.Body
+		)
+		defer oldBody.Close()
+
+		if _, err = body.ReadFrom(oldBody); err != nil {
+			moduleReadErrorCount.WithLabelValues(cfg.name).Inc()
+			return &VerifyError{"Failed to read body from proxied server", err}
+		}
+
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
+
+		var bodyReader io.ReadCloser
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			bodyReader, err = gzip.NewReader(bytes.NewReader(body.Bytes()))
+			if err != nil {
+				moduleReadErrorCount.WithLabelValues(cfg.name).Inc()
+				return &VerifyError{"Failed to decode gzipped response", err}
+			}
+		} else {
+			bodyReader = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
+		}
+		defer bodyReader.Close()
+
+		format := expfmt.ResponseFormat(resp.Header)
+		dec := expfmt.NewDecoder(bodyReader, format)
+		var mfs []*dto.MetricFamily
+		start := clk.Now()
+		for {
+			mf := &dto.MetricFamily{}
+			err := dec.Decode(mf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				proxyMalformedCount.WithLabelValues(cfg.name).Inc()
+				cfg.parseFailed()
+				return &VerifyError{"Failed to decode metrics from proxied server", err}
+			}
+			if err := cfg.HTTP.parseDeadline(resp.Request.Context(), start); err != nil {
+				return &VerifyError{"Failed to decode metrics from proxied server", err}
+			}
+			mfs = append(mfs, mf)
+		}
+
+		reencode := cfg.forceFormat != "" && format != cfg.forceFormat
+		if !cfg.hasPostProcess() && !reencode {
+			return nil
+		}
+
+		if cfg.hasPostProcess() {
+			if mfs, err = cfg.postProcess(resp.Request.Context(), mfs); err != nil {
+				return &VerifyError{"Failed to process metrics from proxied server", err}
+			}
+		}
+		if cfg.forceFormat != "" {
+			format = cfg.forceFormat
+		}
+		if format == expfmt.FmtUnknown {
+			format = expfmt.FmtText
+		}
+		bs, err := encodeFamilies(format, mfs)
+		if err != nil {
+			return &VerifyError{"Failed to encode processed metrics", err}
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(bs))
+		resp.ContentLength = int64(len(bs))
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Set("Content-Length", strconv.Itoa(len(bs)))
+		resp.Header.Set("Content-Type", string(format))
+		return nil
+	}
+}
+
+func (cfg ModuleConfig) getReverseProxyErrorHandlerFunc() func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		var verifyError *VerifyError
+		if errors.As(err, &verifyError) {
+			log.Errorf("Verification for module '%s' failed: %v", cfg.name, err)
+			http.Error(w, VerificationErrorMsg, http.StatusInternalServerError)
+			return
+		}
+
+		moduleReadErrorCount.WithLabelValues(cfg.name).Inc()
+		var tokenError *tokenError
+		if errors.As(err, &tokenError) {
+			log.Errorf("Proxy error for module '%s': %v", cfg.name, err)
+			http.Error(w, "Bad Gateway: failed to obtain an OAuth2 token for the upstream, see server logs for details", http.StatusBadGateway)
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Errorf("Request time out for module '%s'", cfg.name)
+			http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+			return
+		}
+
+		log.Errorf("Proxy error for module '%s': %v", cfg.name, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+	}
+}
+
+// SetPath makes the checked http module cfg scrape path on its upstream
+// instead of the configured one.
+func (cfg *ModuleConfig) SetPath(path string) error {
+	if cfg.Method != "http" {
+		return fmt.Errorf("module %v is not an http module", cfg.name)
+	}
+	if len(cfg.HTTP.Paths) != 0 {
+		return fmt.Errorf("module %v scrapes several paths", cfg.name)
+	}
+	dirFunc, err := cfg.getReverseProxyDirectorFunc(path)
+	if err != nil {
+		return err
+	}
+	cfg.HTTP.Path = path
+	cfg.HTTP.ReverseProxy.Director = dirFunc
+	return nil
+}
+
+func (c HTTPConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.ShardParam != "" {
+		shard := r.URL.Query().Get(c.ShardParam)
+		if _, ok := c.shardURLs[shard]; !ok {
+			log.Warnf("unknown %s %q requested from module %v", c.ShardParam, shard, c.mcfg.name)
+			http.Error(w, fmt.Sprintf("unknown %s %q\n", c.ShardParam, shard), http.StatusNotFound)
+			return
+		}
+	}
+
+	// The upstream has to answer DeadlineMargin before the scrape deadline,
+	// leaving that time for sending the response on to the client.
+	if deadline, ok := r.Context().Deadline(); ok && c.DeadlineMargin > 0 {
+		ctx, cancel := clk.WithTimeout(r.Context(), deadline.Sub(clk.Now())-c.DeadlineMargin)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	if c.FreshnessProbe != nil {
+		c.serveProbed(w, r, c.scrape)
+		return
+	}
+	c.scrape(w, r)
+}
+
+// scrape serves r from the upstream.
+func (c HTTPConfig) scrape(w http.ResponseWriter, r *http.Request) {
+	if len(c.Paths) == 0 {
+		c.ReverseProxy.ServeHTTP(w, r)
+		return
+	}
+	ctx := r.Context()
+	g := c.GatherWithContext(ctx, r)
+	serveGatherer(w, r, recoverGatherer(c.mcfg.name, g))
+}
+
+// GatherWithContext scrapes all the configured paths and merges the
+// results.
+func (c HTTPConfig) GatherWithContext(ctx context.Context, r *http.Request) prometheus.GathererFunc {
+	return func() ([]*dto.MetricFamily, error) {
+		sets := make([][]*dto.MetricFamily, len(c.Paths))
+		eg, ectx := errgroup.WithContext(ctx)
+		for i := range c.Paths {
+			i := i
+			eg.Go(func() error {
+				mfs, err := c.scrapePath(ectx, r, i)
+				if err != nil {
+					return err
+				}
+				if c.PathLabel != "" {
+					addLabel(mfs, c.PathLabel, c.Paths[i])
+				}
+				sets[i] = mfs
+				return nil
+			})
+		}
+		if err := eg.Wait(); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				proxyTimeoutCount.WithLabelValues(c.mcfg.name).Inc()
+			}
+			return nil, err
+		}
+
+		if c.DisambiguateLabel != "" {
+			disambiguate(sets, c.DisambiguateLabel, c.disambiguateValues)
+		}
+
+		result, err := mergeFamilies(sets...)
+		if err != nil {
+			log.Warnf("Http module %v failed to merge paths, %v", c.mcfg.name, err)
+			mergeConflictCount.WithLabelValues(c.mcfg.name).Inc()
+			return nil, err
+		}
+		if c.HelpSource {
+			annotateSources(result, sets, c.disambiguateValues)
+		}
+		return c.mcfg.postProcess(ctx, result)
+	}
+}
+
+// scrapePath fetches and decodes the metrics of the i-th configured path.
+func (c HTTPConfig) scrapePath(ctx context.Context, r *http.Request, i int) ([]*dto.MetricFamily, error) {
+	u := *r.URL
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept := r.Header.Get("Accept"); accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	c.pathDirectors[i](req)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		log.Warnf("Http module %v failed to scrape %v, %v", c.mcfg.name, c.Paths[i], err)
+		moduleReadErrorCount.WithLabelValues(c.mcfg.name).Inc()
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		moduleReadErrorCount.WithLabelValues(c.mcfg.name).Inc()
+		return nil, fmt.Errorf("scraping %v returned status %v", c.Paths[i], resp.Status)
+	}
+
+	body := io.Reader(resp.Body)
+	if c.BodyTimeout > 0 || c.ParseTimeout > 0 {
+		// Reading and parsing are timed separately, so the body is read
+		// completely first.
+		if c.BodyTimeout > 0 {
+			resp.Body = withBodyTimeout(resp.Body, c.BodyTimeout)
+		}
+		bs, err := io.ReadAll(resp.Body)
+		if err != nil {
+			log.Warnf("Http module %v failed to read %v, %v", c.mcfg.name, c.Paths[i], err)
+			moduleReadErrorCount.WithLabelValues(c.mcfg.name).Inc()
+			return nil, err
+		}
+		body = bytes.NewReader(bs)
+	}
+
+	var mfs []*dto.MetricFamily
+	dec := expfmt.NewDecoder(body, expfmt.ResponseFormat(resp.Header))
+	start := clk.Now()
+	for {
+		mf := &dto.MetricFamily{}
+		err := dec.Decode(mf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Warnf("Http module %v failed to decode metrics from %v, %v", c.mcfg.name, c.Paths[i], err)
+			proxyMalformedCount.WithLabelValues(c.mcfg.name).Inc()
+			c.mcfg.parseFailed()
+			return nil, err
+		}
+		if err := c.parseDeadline(ctx, start); err != nil {
+			log.Warnf("Http module %v failed to decode metrics from %v, %v", c.mcfg.name, c.Paths[i], err)
+			return nil, err
+		}
+		mfs = append(mfs, mf)
+	}
+	return mfs, nil
+}
+
+// BearerAuthMiddleware
+type BearerAuthMiddleware struct {
+	http.Handler
+	Token string
+}
+
+func (b BearerAuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("Authorization header is missing"))
+		return
+	}
+	ss := strings.SplitN(authHeader, " ", 2)
+	if !(len(ss) == 2 && ss[0] == "Bearer") {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("Authorization header not of Bearer type"))
+		return
+	}
+	if ss[1] != b.Token {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("Invalid Bearer Token"))
+		return
+	}
+	b.Handler.ServeHTTP(w, r)
+}
+
+var (
+	httpRequestsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_http_requests_total",
+			Help: "Counts of HTTP requests received, by method and status code",
+		},
+		[]string{"method", "code"},
+	)
+)
+
+// requestMethods are the methods counted under their own name, any other is
+// counted as "other".
+var requestMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// RequestCountMiddleware counts all requests in expexp_http_requests_total.
+type RequestCountMiddleware struct {
+	http.Handler
+}
+
+func (m RequestCountMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sr := &statusRecorder{ResponseWriter: w}
+	defer func() {
+		method := r.Method
+		if !requestMethods[method] {
+			method = "other"
+		}
+		status := sr.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequestsCount.WithLabelValues(method, strconv.Itoa(status)).Inc()
+	}()
+	m.Handler.ServeHTTP(sr, r)
+}
+
+type IPAddressAuthMiddleware struct {
+	http.Handler
+	ACL []net.IPNet
+	// TrustedProxies are the networks of reverse proxies whose
+	// X-Forwarded-For and X-Real-IP headers are used to find the client
+	// address.
+	TrustedProxies []net.IPNet
+}
+
+func (m IPAddressAuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	addr, err := ClientIP(r, m.TrustedProxies)
+	if err != nil {
+		log.Errorf("Failed to determine client IP address, %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("Failed to determine client IP address"))
+		return
+	}
+
+	// client is in access list
+	if inNets(m.ACL, addr) {
+		m.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	// client is not in access list
+	log.Infof("Access forbidden for %q", addr)
+	w.WriteHeader(http.StatusForbidden)
+	_, _ = w.Write([]byte("Forbidden"))
+}
+
+func inNets(nets []net.IPNet, addr net.IP) bool {
+	for _, network := range nets {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that made r. If the connection
+// comes from one of the trusted proxies, the address is taken from the
+// X-Forwarded-For header, skipping any further trusted proxies from the
+// right, or from X-Real-IP. Forwarding headers sent by any other peer are
+// ignored.
+func ClientIP(r *http.Request, trusted []net.IPNet) (net.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host from remote address '%s'", r.RemoteAddr)
+	}
+
+	addr := net.ParseIP(host)
+	if addr == nil {
+		return nil, fmt.Errorf("failed to parse IP address from '%s' (originally '%s')", host, r.RemoteAddr)
+	}
+
+	if !inNets(trusted, addr) {
+		return addr, nil
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// anything left of a malformed entry can not be trusted
+			break
+		}
+		addr = hop
+		if !inNets(trusted, hop) {
+			return addr, nil
+		}
+	}
+	if len(hops) != 0 {
+		return addr, nil
+	}
+
+	if real := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); real != nil {
+		return real, nil
+	}
+	return addr, nil
+}
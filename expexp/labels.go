@@ -0,0 +1,127 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The ways of handling metrics carrying the same label name more than once.
+const (
+	duplicateLabelsError = "error"
+	duplicateLabelsFirst = "first"
+	duplicateLabelsLast  = "last"
+)
+
+// dedupLabels removes repeated label names from the metrics in mfs, keeping
+// the first or last value of each according to how. With "error" any
+// repeated label name fails instead.
+func dedupLabels(mfs []*dto.MetricFamily, how string) error {
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			seen := make(map[string]int, len(m.GetLabel()))
+			ls := m.Label[:0]
+			for _, l := range m.GetLabel() {
+				i, dup := seen[l.GetName()]
+				switch {
+				case !dup:
+					seen[l.GetName()] = len(ls)
+					ls = append(ls, l)
+				case how == duplicateLabelsError:
+					return fmt.Errorf("metric %s has duplicate label %s", mf.GetName(), l.GetName())
+				case how == duplicateLabelsLast:
+					ls[i] = l
+				}
+			}
+			m.Label = ls
+		}
+	}
+	return nil
+}
+
+// The ways of handling series which become identical by dropping labels not
+// in label_keep.
+const (
+	labelKeepSum   = "sum"
+	labelKeepError = "error"
+)
+
+// keepLabels drops all labels not in keep from the metrics in mfs. Series
+// left with the same labels are added up into one if how is "sum", or fail
+// with "error".
+func keepLabels(mfs []*dto.MetricFamily, keep map[string]bool, how string) error {
+	for _, mf := range mfs {
+		bySig := make(map[string]*dto.Metric, len(mf.GetMetric()))
+		ms := mf.Metric[:0]
+		for _, m := range mf.GetMetric() {
+			ls := m.Label[:0]
+			for _, l := range m.GetLabel() {
+				if keep[l.GetName()] {
+					ls = append(ls, l)
+				}
+			}
+			m.Label = ls
+
+			sig := seriesSignature(m)
+			first, ok := bySig[sig]
+			if !ok {
+				bySig[sig] = m
+				ms = append(ms, m)
+				continue
+			}
+			if how == labelKeepError {
+				return fmt.Errorf("metric %s has several series with labels %v after dropping labels", mf.GetName(), m.GetLabel())
+			}
+			if err := addSeries(mf.GetType(), first, m); err != nil {
+				return fmt.Errorf("metric %s can not be summed up, %w", mf.GetName(), err)
+			}
+		}
+		mf.Metric = ms
+	}
+	return nil
+}
+
+// addSeries adds the values of m to dst, both metrics of type t.
+func addSeries(t dto.MetricType, dst, m *dto.Metric) error {
+	switch t {
+	case dto.MetricType_COUNTER:
+		dst.Counter = &dto.Counter{Value: proto.Float64(dst.GetCounter().GetValue() + m.GetCounter().GetValue())}
+	case dto.MetricType_GAUGE:
+		dst.Gauge = &dto.Gauge{Value: proto.Float64(dst.GetGauge().GetValue() + m.GetGauge().GetValue())}
+	case dto.MetricType_UNTYPED:
+		dst.Untyped = &dto.Untyped{Value: proto.Float64(dst.GetUntyped().GetValue() + m.GetUntyped().GetValue())}
+	case dto.MetricType_HISTOGRAM:
+		dh, h := dst.GetHistogram(), m.GetHistogram()
+		if len(dh.GetBucket()) != len(h.GetBucket()) {
+			return fmt.Errorf("histograms have different buckets")
+		}
+		for i, b := range h.GetBucket() {
+			if dh.Bucket[i].GetUpperBound() != b.GetUpperBound() {
+				return fmt.Errorf("histograms have different buckets")
+			}
+			dh.Bucket[i].CumulativeCount = proto.Uint64(dh.Bucket[i].GetCumulativeCount() + b.GetCumulativeCount())
+		}
+		dh.SampleCount = proto.Uint64(dh.GetSampleCount() + h.GetSampleCount())
+		dh.SampleSum = proto.Float64(dh.GetSampleSum() + h.GetSampleSum())
+	default:
+		return fmt.Errorf("series of type %v can not be added up", t)
+	}
+	if m.GetTimestampMs() > dst.GetTimestampMs() {
+		dst.TimestampMs = m.TimestampMs
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package expexp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDuplicateLabels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dup.prom")
+	content := "# TYPE m gauge\nm{a=\"1\",b=\"x\",a=\"2\"} 1\nm{a=\"3\"} 2\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		how    string
+		status int
+		want   []string
+	}{
+		{how: "first", status: http.StatusOK, want: []string{`m{a="1",b="x"} 1`, `m{a="3"} 2`}},
+		{how: "last", status: http.StatusOK, want: []string{`m{a="2",b="x"} 1`, `m{a="3"} 2`}},
+		{how: "error", status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.how, func(t *testing.T) {
+			name := "dup_" + tt.how
+			mcfg := &ModuleConfig{
+				Method:          "file",
+				DuplicateLabels: tt.how,
+				File:            FileConfig{Path: path},
+			}
+			if err := CheckModuleConfig(name, mcfg); err != nil {
+				t.Fatalf("Failed to check module config: %v", err)
+			}
+
+			parseErrors := testutil.ToFloat64(moduleParseErrorCount.WithLabelValues(name))
+			rr := httptest.NewRecorder()
+			mcfg.ServeHTTP(rr, httptest.NewRequest("GET", "/proxy?module="+name, nil))
+			if rr.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, rr.Code)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(rr.Body.String(), w+"\n") {
+					t.Errorf("expected %s in output:\n%s", w, rr.Body.String())
+				}
+			}
+
+			errs := testutil.ToFloat64(moduleParseErrorCount.WithLabelValues(name)) - parseErrors
+			if tt.how == "error" && errs != 1 {
+				t.Errorf("expected a parse error to be counted, got %v", errs)
+			}
+			if tt.how != "error" && errs != 0 {
+				t.Errorf("expected no parse error to be counted, got %v", errs)
+			}
+		})
+	}
+}
+
+func TestDuplicateLabelsInvalid(t *testing.T) {
+	mcfg := &ModuleConfig{
+		Method:          "file",
+		DuplicateLabels: "merge",
+		File:            FileConfig{Path: "/dev/null"},
+	}
+	if err := CheckModuleConfig("dup_invalid", mcfg); err == nil {
+		t.Fatal("expected an unknown duplicate_labels value to be rejected")
+	}
+}
+
+func TestLabelKeep(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keep.prom")
+	content := `# TYPE c counter
+c{job="a",pod="1"} 1
+c{job="a",pod="2"} 2
+c{job="b",pod="3"} 4
+# TYPE h histogram
+h_bucket{pod="1",le="1"} 1
+h_bucket{pod="1",le="+Inf"} 2
+h_sum{pod="1"} 3
+h_count{pod="1"} 2
+h_bucket{pod="2",le="1"} 0
+h_bucket{pod="2",le="+Inf"} 1
+h_sum{pod="2"} 5
+h_count{pod="2"} 1
+`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		how    string
+		status int
+		want   []string
+	}{
+		{how: "sum", status: http.StatusOK, want: []string{`c{job="a"} 3`, `c{job="b"} 4`, `h_bucket{le="1"} 1`, `h_bucket{le="+Inf"} 3`, `h_sum 8`, `h_count 3`}},
+		{how: "error", status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.how, func(t *testing.T) {
+			name := "keep_" + tt.how
+			mcfg := &ModuleConfig{
+				Method:              "file",
+				LabelKeep:           []string{"job"},
+				LabelKeepCollisions: tt.how,
+				File:                FileConfig{Path: path},
+			}
+			if err := CheckModuleConfig(name, mcfg); err != nil {
+				t.Fatalf("Failed to check module config: %v", err)
+			}
+
+			rr := httptest.NewRecorder()
+			mcfg.ServeHTTP(rr, httptest.NewRequest("GET", "/proxy?module="+name, nil))
+			if rr.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, rr.Code)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(rr.Body.String(), w+"\n") {
+					t.Errorf("expected %s in output:\n%s", w, rr.Body.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package expexp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNoGoroutineLeaks(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		case "/bad":
+			fmt.Fprintln(w, "not metrics{")
+		default:
+			fmt.Fprintln(w, "up 1")
+		}
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.prom")
+	if err := ioutil.WriteFile(good, []byte("up 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := 20 * time.Millisecond
+	modules := map[string]*ModuleConfig{
+		"exec_ok":      {Method: "exec", Exec: ExecConfig{Command: "echo", Args: []string{"up 1"}}},
+		"exec_fail":    {Method: "exec", Exec: ExecConfig{Command: "false"}},
+		"exec_timeout": {Method: "exec", Timeout: timeout, Exec: ExecConfig{Command: "sleep", Args: []string{"5"}}},
+		"file_ok":      {Method: "file", File: FileConfig{Path: good}},
+		"file_missing": {Method: "file", File: FileConfig{Path: filepath.Join(dir, "missing.prom")}},
+		"http_ok":      {Method: "http", HTTP: HTTPConfig{Address: u.Hostname(), Port: port, Path: "/"}},
+		"http_bad":     {Method: "http", HTTP: HTTPConfig{Address: u.Hostname(), Port: port, Path: "/bad"}},
+		"http_timeout": {Method: "http", Timeout: timeout, HTTP: HTTPConfig{Address: u.Hostname(), Port: port, Path: "/slow"}},
+		"http_paths":   {Method: "http", HTTP: HTTPConfig{Address: u.Hostname(), Port: port, Paths: []string{"/", "/slow"}}, Timeout: timeout},
+	}
+	for name, mcfg := range modules {
+		if err := CheckModuleConfig(name, mcfg); err != nil {
+			t.Fatalf("Failed to check module config %s: %v", name, err)
+		}
+	}
+	cfg := &Config{Modules: modules}
+
+	closeIdle := func() {
+		for _, mcfg := range modules {
+			if mcfg.HTTP.ReverseProxy != nil {
+				mcfg.HTTP.ReverseProxy.Transport.(*http.Transport).CloseIdleConnections()
+			}
+			if mcfg.HTTP.client != nil {
+				mcfg.HTTP.client.CloseIdleConnections()
+			}
+		}
+	}
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		for name := range modules {
+			rr := httptest.NewRecorder()
+			cfg.doProxy(rr, httptest.NewRequest("GET", "/proxy?module="+name, nil))
+		}
+	}
+
+	// Killed commands and cancelled upstream requests are cleaned up
+	// asynchronously, give them some time.
+	var after int
+	for i := 0; i < 100; i++ {
+		closeIdle()
+		after = runtime.NumGoroutine()
+		if after <= before {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	t.Fatalf("expected at most %d goroutines, got %d:\n%s", before, after, buf)
+}
@@ -0,0 +1,136 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	mergeConflictCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_merge_conflicts_total",
+			Help: "Counts of scrapes failed because merged sources conflicted",
+		},
+		[]string{"module"},
+	)
+)
+
+// seriesSignature identifies a metric by its label set.
+func seriesSignature(m *dto.Metric) string {
+	ls := make([]string, 0, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		ls = append(ls, l.GetName()+"\xff"+l.GetValue())
+	}
+	sort.Strings(ls)
+	return strings.Join(ls, "\xfe")
+}
+
+// addLabel adds a label to every metric of the families.
+func addLabel(mfs []*dto.MetricFamily, name, value string) {
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &value})
+		}
+	}
+}
+
+// disambiguate adds the label name to the series which are provided by more
+// than one of the sets, so that they can be merged. The series of sets[i]
+// get values[i].
+func disambiguate(sets [][]*dto.MetricFamily, name string, values []string) {
+	sources := map[string]map[string]int{}
+	for _, mfs := range sets {
+		for _, mf := range mfs {
+			if sources[mf.GetName()] == nil {
+				sources[mf.GetName()] = map[string]int{}
+			}
+			seen := map[string]bool{}
+			for _, m := range mf.GetMetric() {
+				sig := seriesSignature(m)
+				if !seen[sig] {
+					seen[sig] = true
+					sources[mf.GetName()][sig]++
+				}
+			}
+		}
+	}
+	for i, mfs := range sets {
+		value := values[i]
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				if sources[mf.GetName()][seriesSignature(m)] > 1 {
+					m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &value})
+				}
+			}
+		}
+	}
+}
+
+// mergeFamilies combines the metric families obtained from several sources
+// into one set. Families of the same name must have the same type in every
+// source, and no series may be provided by more than one source. The HELP
+// text of the first source providing a family is kept.
+func mergeFamilies(sets ...[]*dto.MetricFamily) ([]*dto.MetricFamily, error) {
+	var res []*dto.MetricFamily
+	byName := map[string]*dto.MetricFamily{}
+	series := map[string]map[string]bool{}
+	for _, mfs := range sets {
+		for _, mf := range mfs {
+			name := mf.GetName()
+			merged, ok := byName[name]
+			if !ok {
+				merged = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+				byName[name] = merged
+				series[name] = map[string]bool{}
+				res = append(res, merged)
+			} else if merged.GetType() != mf.GetType() {
+				return nil, fmt.Errorf("metric %s has conflicting types %v and %v", name, merged.GetType(), mf.GetType())
+			}
+			for _, m := range mf.GetMetric() {
+				sig := seriesSignature(m)
+				if series[name][sig] {
+					return nil, fmt.Errorf("metric %s has duplicate series %v", name, m.GetLabel())
+				}
+				series[name][sig] = true
+				merged.Metric = append(merged.Metric, m)
+			}
+		}
+	}
+	return res, nil
+}
+
+// annotateSources appends the sources providing each of the merged families
+// to its HELP text, as "(from a, b)". The families of sets[i] come from
+// sources[i].
+func annotateSources(merged []*dto.MetricFamily, sets [][]*dto.MetricFamily, sources []string) {
+	from := map[string][]string{}
+	for i, mfs := range sets {
+		for _, mf := range mfs {
+			from[mf.GetName()] = append(from[mf.GetName()], sources[i])
+		}
+	}
+	for _, mf := range merged {
+		help := "(from " + strings.Join(from[mf.GetName()], ", ") + ")"
+		if mf.GetHelp() != "" {
+			help = mf.GetHelp() + " " + help
+		}
+		mf.Help = &help
+	}
+}
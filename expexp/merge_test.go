@@ -0,0 +1,39 @@
+package expexp
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestAnnotateSources(t *testing.T) {
+	family := func(name, help string) *dto.MetricFamily {
+		mf := &dto.MetricFamily{Name: &name}
+		if help != "" {
+			mf.Help = &help
+		}
+		return mf
+	}
+	sets := [][]*dto.MetricFamily{
+		{family("shared", "Shared metric"), family("first", "")},
+		{family("shared", "Other help")},
+	}
+	merged, err := mergeFamilies(sets...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotateSources(merged, sets, []string{"/a", "/b"})
+
+	want := map[string]string{
+		"shared": "Shared metric (from /a, /b)",
+		"first":  "(from /a)",
+	}
+	for _, mf := range merged {
+		if got := mf.GetHelp(); got != want[mf.GetName()] {
+			t.Errorf("expected HELP %q for %v, got %q", want[mf.GetName()], mf.GetName(), got)
+		}
+	}
+	if got := sets[0][0].GetHelp(); got != "Shared metric" {
+		t.Errorf("expected the source family to be left alone, got %q", got)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// monotonicResetFraction is the fraction of its previous value below
+	// which a decreasing counter is taken to have been reset.
+	monotonicResetFraction = 0.1
+	// monotonicMaxHolds is the number of scrapes in a row the previous
+	// value of a counter is held, before a decrease is accepted as a reset.
+	monotonicMaxHolds = 3
+	// defaultMonotonicMaxSeries bounds the counter series remembered per
+	// module unless monotonic_max_series is set.
+	defaultMonotonicMaxSeries = 10000
+)
+
+var monotonicHeldCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "expexp_monotonic_held_values_total",
+		Help: "Counts of decreased counter values replaced by their previous value with monotonic_counters",
+	},
+	[]string{"module"},
+)
+
+type monotonicSeries struct {
+	value float64
+	holds int
+}
+
+// monotonicState remembers the counter values of the previous scrape of a
+// module.
+type monotonicState struct {
+	sync.Mutex
+	maxSeries int
+	series    map[string]monotonicSeries
+	full      bool
+}
+
+func newMonotonicState(maxSeries int) *monotonicState {
+	return &monotonicState{maxSeries: maxSeries, series: map[string]monotonicSeries{}}
+}
+
+// apply replaces counter values lower than in the previous scrape by the
+// previous value, unless the counter dropped below monotonicResetFraction
+// of it or stayed lower for monotonicMaxHolds scrapes, which are taken as
+// legitimate resets. Only the series of this scrape are remembered, at
+// most maxSeries of them; others pass unchanged.
+func (s *monotonicState) apply(name string, mfs []*dto.MetricFamily) {
+	s.Lock()
+	defer s.Unlock()
+	next := make(map[string]monotonicSeries, len(s.series))
+	full := false
+	for _, mf := range mfs {
+		if mf.GetType() != dto.MetricType_COUNTER {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if len(next) >= s.maxSeries {
+				full = true
+				break
+			}
+			key := mf.GetName() + "\xfd" + seriesSignature(m)
+			v := m.GetCounter().GetValue()
+			prev, ok := s.series[key]
+			if ok && v < prev.value && v >= prev.value*monotonicResetFraction && prev.holds < monotonicMaxHolds {
+				monotonicHeldCount.WithLabelValues(name).Inc()
+				m.Counter = &dto.Counter{Value: proto.Float64(prev.value)}
+				next[key] = monotonicSeries{value: prev.value, holds: prev.holds + 1}
+				continue
+			}
+			next[key] = monotonicSeries{value: v}
+		}
+	}
+	if full && !s.full {
+		log.Warnf("Module %v has more than %d counter series, not keeping the others monotonic", name, s.maxSeries)
+	}
+	s.series, s.full = next, full
+}
@@ -0,0 +1,41 @@
+package expexp
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMonotonicCounters(t *testing.T) {
+	s := newMonotonicState(10)
+	scrape := func(v float64) float64 {
+		mfs := []*dto.MetricFamily{{
+			Name:   proto.String("requests_total"),
+			Type:   dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(v)}}},
+		}}
+		s.apply("monotonic", mfs)
+		return mfs[0].Metric[0].GetCounter().GetValue()
+	}
+
+	for i, c := range []struct{ in, want float64 }{
+		{100, 100},
+		{120, 120},
+		// a glitch is held at the previous value
+		{60, 120},
+		{130, 130},
+		// a drop below the reset fraction is a reset
+		{5, 5},
+		{50, 50},
+		// a decrease lasting longer than the holds is accepted
+		{30, 50},
+		{31, 50},
+		{32, 50},
+		{33, 33},
+	} {
+		if got := scrape(c.in); got != c.want {
+			t.Errorf("scrape %d: expected %v for %v, got %v", i, c.want, c.in, got)
+		}
+	}
+}
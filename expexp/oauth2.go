@@ -0,0 +1,107 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// oauth2TokenTimeout bounds requests to the token endpoint. Tokens are
+// fetched independently of the scrapes waiting for them.
+const oauth2TokenTimeout = 10 * time.Second
+
+// OAuth2Config configures the OAuth2 client credentials flow used to obtain
+// bearer tokens for the requests of an http module to its upstream.
+type OAuth2Config struct {
+	TokenURL       string                 `yaml:"token_url"`
+	ClientID       string                 `yaml:"client_id"`
+	ClientSecret   string                 `yaml:"client_secret" json:"-"`
+	Scopes         []string               `yaml:"scopes"`          // no default
+	EndpointParams map[string]string      `yaml:"endpoint_params"` // no default
+	XXX            map[string]interface{} `yaml:",inline"`
+}
+
+// MarshalJSON leaves out the client secret and the password of the token
+// URL, module listings are served to any client.
+func (c OAuth2Config) MarshalJSON() ([]byte, error) {
+	type plain OAuth2Config
+	p := plain(c)
+	if u, err := url.Parse(p.TokenURL); err == nil {
+		p.TokenURL = u.Redacted()
+	}
+	return json.Marshal(p)
+}
+
+func (c *OAuth2Config) check() error {
+	if len(c.XXX) != 0 {
+		return fmt.Errorf("Unknown oauth2 configuration fields: %v", c.XXX)
+	}
+	if c.ClientID == "" || c.ClientSecret == "" {
+		return fmt.Errorf("oauth2 client_id and client_secret are mandatory")
+	}
+	u, err := url.Parse(c.TokenURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("oauth2 token_url %q is not a valid http or https URL", c.TokenURL)
+	}
+	return nil
+}
+
+// tokenError is the failure to obtain a token for an upstream request.
+type tokenError struct {
+	cause error
+}
+
+func (e *tokenError) Error() string { return "failed to obtain an OAuth2 token: " + e.cause.Error() }
+func (e *tokenError) Unwrap() error { return e.cause }
+
+type tokenSource struct {
+	oauth2.TokenSource
+}
+
+func (s tokenSource) Token() (*oauth2.Token, error) {
+	t, err := s.TokenSource.Token()
+	if err != nil {
+		return nil, &tokenError{err}
+	}
+	return t, nil
+}
+
+// transport returns base, adding the bearer tokens obtained according to c
+// to every request. Tokens are cached and refreshed once they expire.
+func (c *OAuth2Config) transport(base http.RoundTripper) http.RoundTripper {
+	params := url.Values{}
+	for k, v := range c.EndpointParams {
+		params.Set(k, v)
+	}
+	cc := &clientcredentials.Config{
+		ClientID:       c.ClientID,
+		ClientSecret:   c.ClientSecret,
+		TokenURL:       c.TokenURL,
+		Scopes:         c.Scopes,
+		EndpointParams: params,
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Timeout: oauth2TokenTimeout})
+	return &oauth2.Transport{
+		Source: tokenSource{cc.TokenSource(ctx)},
+		Base:   base,
+	}
+}
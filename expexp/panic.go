@@ -0,0 +1,55 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	modulePanicsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_module_panics_total",
+			Help: "Counts of panics recovered while gathering the metrics of a module",
+		},
+		[]string{"module"},
+	)
+)
+
+// recoverGatherer returns g, turning panics while gathering the metrics of
+// module name into gather errors. http.ErrAbortHandler is passed on, it is
+// how handlers deliberately abort a response.
+func recoverGatherer(name string, g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() (mfs []*dto.MetricFamily, err error) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			log.Errorf("Module %v panicked while gathering metrics, %v\n%s", name, p, debug.Stack())
+			modulePanicsCount.WithLabelValues(name).Inc()
+			mfs, err = nil, fmt.Errorf("module %v panicked: %v", name, p)
+		}()
+		return g.Gather()
+	})
+}
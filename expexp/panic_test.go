@@ -0,0 +1,50 @@
+package expexp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestGathererPanic(t *testing.T) {
+	name := "panicking"
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		var mf *dto.MetricFamily
+		return []*dto.MetricFamily{{Name: mf.Name}}, nil
+	})
+
+	panics := testutil.ToFloat64(modulePanicsCount.WithLabelValues(name))
+	rr := httptest.NewRecorder()
+	serveGatherer(rr, httptest.NewRequest("GET", "/proxy?module="+name, nil), recoverGatherer(name, g))
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "module panicking panicked") {
+		t.Errorf("expected the panic in the response, got:\n%s", rr.Body.String())
+	}
+	if n := testutil.ToFloat64(modulePanicsCount.WithLabelValues(name)) - panics; n != 1 {
+		t.Errorf("expected a panic to be counted, got %v", n)
+	}
+}
+
+func TestGathererAbort(t *testing.T) {
+	name := "aborting"
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		panic(http.ErrAbortHandler)
+	})
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("expected http.ErrAbortHandler to be passed on, got %v", p)
+		}
+		if n := testutil.ToFloat64(modulePanicsCount.WithLabelValues(name)); n != 0 {
+			t.Errorf("expected no panic to be counted, got %v", n)
+		}
+	}()
+	recoverGatherer(name, g).Gather()
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// timedBody is a response body which is closed if it is not completely read
+// and closed within a body_timeout. Reads then fail with an error saying so.
+type timedBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	cancel  context.CancelFunc
+	expired int32
+}
+
+// withBodyTimeout returns body, limited to be read within d.
+func withBodyTimeout(body io.ReadCloser, d time.Duration) io.ReadCloser {
+	ctx, cancel := clk.WithTimeout(context.Background(), d)
+	b := &timedBody{ReadCloser: body, timeout: d, cancel: cancel}
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			atomic.StoreInt32(&b.expired, 1)
+			body.Close()
+		}
+	}()
+	return b
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && atomic.LoadInt32(&b.expired) == 1 {
+		err = fmt.Errorf("upstream response body not read within body_timeout of %v", b.timeout)
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// parseDeadline checks that parsing started at start is within the
+// parse_timeout of c, and ctx is not done.
+func (c HTTPConfig) parseDeadline(ctx context.Context, start time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.ParseTimeout > 0 && clk.Now().Sub(start) > c.ParseTimeout {
+		return fmt.Errorf("upstream response not parsed within parse_timeout of %v", c.ParseTimeout)
+	}
+	return nil
+}
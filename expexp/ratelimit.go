@@ -0,0 +1,83 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var rateLimitedCount = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "expexp_module_rate_limited_total",
+		Help: "Counts of requests to a module refused with 429 for exceeding max_rps",
+	},
+	[]string{"module"},
+)
+
+// rateLimiter is a token bucket allowing rate requests per second on
+// average, and bursts of up to burst requests.
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a full bucket for rate requests per second. The
+// burst is the rate rounded up, at least 1.
+func newRateLimiter(rate float64) *rateLimiter {
+	burst := math.Max(1, math.Ceil(rate))
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: clk.Now()}
+}
+
+// allow takes a token if there is one. Otherwise it returns how long it
+// takes until the next one is available.
+func (l *rateLimiter) allow() (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	now := clk.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// rateAllowed reports whether r is within the MaxRPS of m, and responds with
+// 429 if it is not.
+func (m ModuleConfig) rateAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if m.limiter == nil {
+		return true
+	}
+	ok, wait := m.limiter.allow()
+	if ok {
+		return true
+	}
+	log.Debugf("Module %v refused request from %v exceeding max_rps %v", m.name, r.RemoteAddr, m.MaxRPS)
+	rateLimitedCount.WithLabelValues(m.name).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, fmt.Sprintf("Module %v is limited to %v requests per second", m.name, m.MaxRPS), http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,48 @@
+package expexp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMaxRPS(t *testing.T) {
+	fc := withFakeClock(t)
+	m := &ModuleConfig{Method: "sentinel", MaxRPS: 2}
+	if err := CheckModuleConfig("max_rps", m); err != nil {
+		t.Fatalf("Failed to check module config: %v", err)
+	}
+	scrape := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		m.ServeHTTP(rr, httptest.NewRequest("GET", "/proxy?module=max_rps", nil))
+		return rr
+	}
+
+	before := testutil.ToFloat64(rateLimitedCount.WithLabelValues("max_rps"))
+	for i := 0; i < 2; i++ {
+		if rr := scrape(); rr.Code != http.StatusOK {
+			t.Fatalf("expected request %d within the burst to succeed, got %v", i, rr.Code)
+		}
+	}
+	rr := scrape()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 beyond max_rps, got %v", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("expected Retry-After 1, got %q", got)
+	}
+	if got := testutil.ToFloat64(rateLimitedCount.WithLabelValues("max_rps")) - before; got != 1 {
+		t.Errorf("expected 1 rate limited request, got %v", got)
+	}
+
+	fc.Advance(500 * time.Millisecond)
+	if rr := scrape(); rr.Code != http.StatusOK {
+		t.Errorf("expected a request to succeed once a token refilled, got %v", rr.Code)
+	}
+	if rr := scrape(); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 with the refilled token used up, got %v", rr.Code)
+	}
+}
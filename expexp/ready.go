@@ -0,0 +1,163 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// readiness serves the readiness gate. It reports ready once every module
+// in ReadyRequires has been scraped successfully and the modules with
+// WarmOnStart have been warmed, or ReadyTimeout has passed since it was
+// created. Once ready, it stays ready unless a reload of the configuration
+// fails.
+type readiness struct {
+	cfg   *Config
+	start time.Time
+
+	once   sync.Once
+	ready  int32
+	failed atomic.Value // string, the error of the failed reload
+}
+
+func newReadiness(cfg *Config) *readiness {
+	return &readiness{cfg: cfg, start: clk.Now()}
+}
+
+// warming reports whether the modules with WarmOnStart are still being
+// warmed, for at most WarmTimeout.
+func (rd *readiness) warming() bool {
+	if rd.cfg.warmed == nil {
+		return false
+	}
+	select {
+	case <-rd.cfg.warmed:
+		return false
+	default:
+	}
+	return clk.Now().Sub(rd.start) < rd.cfg.Global.WarmTimeout
+}
+
+// waiting returns the required modules which have not succeeded yet, and
+// the modules being warmed.
+func (rd *readiness) waiting() []string {
+	var res []string
+	if rd.warming() {
+		res = rd.cfg.warmModules()
+	}
+	for _, name := range rd.cfg.Global.ReadyRequires {
+		if m, ok := rd.cfg.Modules[name]; !ok || !m.state.hasSucceeded() {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+func (rd *readiness) isReady() bool {
+	if atomic.LoadInt32(&rd.ready) == 1 {
+		return true
+	}
+	waiting := rd.waiting()
+	if len(waiting) != 0 {
+		t := rd.cfg.Global.ReadyTimeout
+		if t == 0 || clk.Now().Sub(rd.start) < t {
+			return false
+		}
+		rd.once.Do(func() {
+			log.Warnf("Ready after %v without successful scrapes of modules %v", t, waiting)
+		})
+	}
+	atomic.StoreInt32(&rd.ready, 1)
+	return true
+}
+
+// ReloadFailed reports cfg as not ready because the configuration meant to
+// replace it failed to load with err. It is ready again once a configuration
+// that loads adopts it.
+func (cfg *Config) ReloadFailed(err error) {
+	if cfg.ready == nil {
+		cfg.ready = newReadiness(cfg)
+	}
+	cfg.ready.failed.Store(err.Error())
+}
+
+func (rd *readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err, _ := rd.failed.Load().(string); err != "" {
+		http.Error(w, fmt.Sprintf("Failed to reload the configuration: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+	if !rd.isReady() {
+		http.Error(w, fmt.Sprintf("Waiting for modules: %s", strings.Join(rd.waiting(), ", ")), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "Ready")
+}
+
+// healthWeight serves a weight from 0 to 100 for load balancers, the
+// percentage of the counted modules whose latest scrape succeeded. Modules
+// which have not been scraped yet are left out, with none left the weight is
+// 100.
+type healthWeight struct {
+	cfg *Config
+}
+
+// counted returns the modules the weight is computed from, the ones in
+// HealthWeightModules or all but the health modules.
+func (hw healthWeight) counted() []*ModuleConfig {
+	if names := hw.cfg.Global.HealthWeightModules; len(names) != 0 {
+		res := make([]*ModuleConfig, 0, len(names))
+		for _, name := range names {
+			if m, ok := hw.cfg.Modules[name]; ok {
+				res = append(res, m)
+			}
+		}
+		return res
+	}
+	res := make([]*ModuleConfig, 0, len(hw.cfg.Modules))
+	for _, m := range hw.cfg.Modules {
+		if m.Method != "health" {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+func (hw healthWeight) weight() int {
+	scraped, up := 0, 0
+	for _, m := range hw.counted() {
+		if m.state == nil || atomic.LoadInt32(&m.state.scraped) == 0 {
+			continue
+		}
+		scraped++
+		if atomic.LoadInt32(&m.state.up) == 1 {
+			up++
+		}
+	}
+	if scraped == 0 {
+		return 100
+	}
+	return 100 * up / scraped
+}
+
+func (hw healthWeight) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, hw.weight())
+}
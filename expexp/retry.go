@@ -0,0 +1,95 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	connectRetriesCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_connect_retries_total",
+			Help: "Counts of retried connection attempts to upstream exporters",
+		},
+		[]string{"module"},
+	)
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// backoff computes exponentially growing delays between retries. Up to the
+// jitter fraction of each delay is randomly taken off, so clients failing at
+// the same time do not retry in lockstep.
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	jitter  float64
+	rnd     func() float64
+}
+
+// delay returns the time to wait before the given retry, counting from 0.
+func (b backoff) delay(retry int) time.Duration {
+	d := b.initial
+	for i := 0; i < retry && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	if b.jitter > 0 {
+		rnd := b.rnd
+		if rnd == nil {
+			rnd = rand.Float64
+		}
+		d -= time.Duration(b.jitter * rnd() * float64(d))
+	}
+	return d
+}
+
+// sleep waits for d, returning the context error early if ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	tctx, cancel := clk.WithTimeout(ctx, d)
+	defer cancel()
+	<-tctx.Done()
+	return ctx.Err()
+}
+
+// retryDial wraps dial to retry failed connection attempts up to retries
+// times, waiting according to b in between. No retry is started if its delay
+// would not end before the deadline of the context.
+func retryDial(name string, dial dialFunc, retries int, b backoff) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		for i := 0; err != nil && i < retries; i++ {
+			d := b.delay(i)
+			if d >= remaining(ctx, d+1) {
+				break
+			}
+			log.Debugf("Connecting to upstream of module %v failed, retrying in %v, %v", name, d, err)
+			if serr := sleep(ctx, d); serr != nil {
+				break
+			}
+			connectRetriesCount.WithLabelValues(name).Inc()
+			conn, err = dial(ctx, network, addr)
+		}
+		return conn, err
+	}
+}
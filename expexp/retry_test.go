@@ -0,0 +1,86 @@
+package expexp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := backoff{initial: 100 * time.Millisecond, max: time.Second}
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, e := range expected {
+		if d := b.delay(i); d != e {
+			t.Errorf("retry %d: expected delay %v, got %v", i, e, d)
+		}
+	}
+
+	b.jitter = 0.5
+	b.rnd = func() float64 { return 1 }
+	if d := b.delay(1); d != 100*time.Millisecond {
+		t.Errorf("expected full jitter to halve the delay, got %v", d)
+	}
+	b.rnd = func() float64 { return 0 }
+	if d := b.delay(1); d != 200*time.Millisecond {
+		t.Errorf("expected no jitter to keep the delay, got %v", d)
+	}
+}
+
+func TestRetryDialDeadline(t *testing.T) {
+	errDial := errors.New("connection refused")
+	attempts := 0
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		attempts++
+		return nil, errDial
+	}
+	b := backoff{initial: 10 * time.Millisecond, max: 40 * time.Millisecond}
+	rd := retryDial("retry_deadline", dial, 100, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	st := time.Now()
+	_, err := rd(ctx, "tcp", "127.0.0.1:1")
+	if err != errDial {
+		t.Errorf("expected the dial error, got %v", err)
+	}
+	if el := time.Since(st); el > 150*time.Millisecond {
+		t.Errorf("expected retries to stop before the deadline, took %v", el)
+	}
+	// 10ms, 20ms, 40ms and 40ms fit within the deadline, the next 40ms
+	// delay would not end before the deadline any more.
+	if attempts < 2 || attempts > 6 {
+		t.Errorf("expected retries to be bounded by the deadline, got %d attempts", attempts)
+	}
+}
+
+func TestRetryDialCancel(t *testing.T) {
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	rd := retryDial("retry_cancel", dial, 1, backoff{initial: time.Minute, max: time.Minute})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	done := make(chan struct{})
+	go func() {
+		rd(ctx, "tcp", "127.0.0.1:1")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("backoff sleep was not interrupted by cancellation")
+	}
+}
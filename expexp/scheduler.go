@@ -0,0 +1,158 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var moduleQueueDepth = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "expexp_module_queue_depth",
+		Help: "Number of scrapes of a module waiting for one of the global max_concurrent slots",
+	},
+	[]string{"module"},
+)
+
+type schedWaiter struct {
+	seq   uint64
+	ready chan struct{}
+}
+
+type schedModule struct {
+	weight  int
+	running int
+	queue   []*schedWaiter
+}
+
+// scheduler hands out the global max_concurrent scrape slots. Whenever a
+// slot is free and scrapes are waiting, it goes to the module that started
+// waiting first, or with fair queuing to the waiting module with the
+// fewest running scrapes relative to its weight, the one that started
+// waiting first among equals. Scrapes of one module get slots in the order
+// they arrived.
+type scheduler struct {
+	sync.Mutex
+	limit   int
+	fair    bool
+	running int
+	seq     uint64
+	modules map[string]*schedModule
+}
+
+func newScheduler(limit int, fair bool) *scheduler {
+	return &scheduler{limit: limit, fair: fair, modules: map[string]*schedModule{}}
+}
+
+func (s *scheduler) module(name string, weight int) *schedModule {
+	sm, ok := s.modules[name]
+	if !ok {
+		sm = &schedModule{weight: weight}
+		s.modules[name] = sm
+	}
+	return sm
+}
+
+// acquire waits for a slot for a scrape of module name, until ctx is done.
+// The returned function releases the slot.
+func (s *scheduler) acquire(ctx context.Context, name string, weight int) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	release := func() { s.release(name) }
+
+	s.Lock()
+	sm := s.module(name, weight)
+	s.seq++
+	w := &schedWaiter{seq: s.seq, ready: make(chan struct{})}
+	sm.queue = append(sm.queue, w)
+	moduleQueueDepth.WithLabelValues(name).Set(float64(len(sm.queue)))
+	s.dispatch()
+	s.Unlock()
+
+	st := clk.Now()
+	defer func() {
+		moduleQueueWait.WithLabelValues(name).Observe(clk.Now().Sub(st).Seconds())
+	}()
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for i, qw := range sm.queue {
+		if qw == w {
+			sm.queue = append(sm.queue[:i], sm.queue[i+1:]...)
+			moduleQueueDepth.WithLabelValues(name).Set(float64(len(sm.queue)))
+			return nil, ctx.Err()
+		}
+	}
+	// The slot was handed out while giving up, pass it on.
+	s.running--
+	sm.running--
+	s.dispatch()
+	return nil, ctx.Err()
+}
+
+func (s *scheduler) release(name string) {
+	s.Lock()
+	defer s.Unlock()
+	s.running--
+	s.modules[name].running--
+	s.dispatch()
+}
+
+// dispatch hands out free slots to waiting scrapes. It must be called with
+// s locked.
+func (s *scheduler) dispatch() {
+	for s.running < s.limit {
+		var next *schedModule
+		var nextName string
+		for name, sm := range s.modules {
+			if len(sm.queue) == 0 {
+				continue
+			}
+			if next == nil || s.before(sm, next) {
+				next, nextName = sm, name
+			}
+		}
+		if next == nil {
+			return
+		}
+		w := next.queue[0]
+		next.queue = next.queue[1:]
+		moduleQueueDepth.WithLabelValues(nextName).Set(float64(len(next.queue)))
+		s.running++
+		next.running++
+		close(w.ready)
+	}
+}
+
+// before reports whether the waiting scrapes of a get the next slot rather
+// than those of b.
+func (s *scheduler) before(a, b *schedModule) bool {
+	if s.fair {
+		// Compare running/weight without dividing.
+		ra, rb := a.running*b.weight, b.running*a.weight
+		if ra != rb {
+			return ra < rb
+		}
+	}
+	return a.queue[0].seq < b.queue[0].seq
+}
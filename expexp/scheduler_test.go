@@ -0,0 +1,66 @@
+package expexp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSchedulerFairQueuing(t *testing.T) {
+	for _, c := range []struct {
+		fair bool
+		want string
+	}{
+		{false, "a"},
+		{true, "b"},
+	} {
+		s := newScheduler(2, c.fair)
+		ctx, cancel := context.WithCancel(context.Background())
+		ra, _ := s.acquire(ctx, "a", 1)
+		s.acquire(ctx, "a", 1)
+
+		got := make(chan string, 2)
+		wait := func(name string) {
+			if _, err := s.acquire(ctx, name, 1); err == nil {
+				got <- name
+			}
+		}
+		go wait("a")
+		for s.waiting("a") != 1 {
+			time.Sleep(time.Millisecond)
+		}
+		go wait("b")
+		for s.waiting("b") != 1 {
+			time.Sleep(time.Millisecond)
+		}
+
+		ra()
+		if name := <-got; name != c.want {
+			t.Errorf("fair %v: expected the free slot to go to %v, got %v", c.fair, c.want, name)
+		}
+		cancel()
+	}
+}
+
+func TestSchedulerGiveUp(t *testing.T) {
+	s := newScheduler(1, true)
+	release, _ := s.acquire(context.Background(), "a", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err := s.acquire(ctx, "b", 1); err == nil {
+		t.Fatalf("expected waiting for a slot to fail")
+	}
+	release()
+	if _, err := s.acquire(context.Background(), "b", 1); err != nil {
+		t.Errorf("expected the released slot to be free, got %v", err)
+	}
+}
+
+func (s *scheduler) waiting(name string) int {
+	s.Lock()
+	defer s.Unlock()
+	if sm, ok := s.modules[name]; ok {
+		return len(sm.queue)
+	}
+	return 0
+}
@@ -0,0 +1,39 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// sentinelGatherer always returns the expexp_sentinel metric, so sentinel
+// modules exercise the full exposition path without depending on a backend.
+var sentinelGatherer = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+	return []*dto.MetricFamily{{
+		Name: proto.String("expexp_sentinel"),
+		Help: proto.String("Always 1, served by sentinel modules to check that exporter_exporter responds"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{
+			Gauge: &dto.Gauge{Value: proto.Float64(1)},
+		}},
+	}}, nil
+})
+
+func serveSentinel(w http.ResponseWriter, r *http.Request) {
+	serveGatherer(w, r, sentinelGatherer)
+}
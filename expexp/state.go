@@ -0,0 +1,210 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultParseFailureCooldown is how long scrapes of a module are failed
+// once it reached its parse_failure_threshold.
+const defaultParseFailureCooldown = 30 * time.Second
+
+// moduleState holds what is known about a module at runtime. It is shared by
+// all copies of a ModuleConfig.
+type moduleState struct {
+	// lastSuccess is the time of the latest successful scrape in Unix
+	// nanoseconds, up whether the latest scrape succeeded and scraped
+	// whether there has been any scrape yet.
+	lastSuccess int64
+	up          int32
+	scraped     int32
+	inFlight    int32
+
+	// slots limits the concurrent scrapes to MaxConcurrent, if set.
+	slots chan struct{}
+
+	// parseFailures counts the consecutive parse failures, cooldownUntil
+	// is the end of the current parse failure cooldown in Unix
+	// nanoseconds.
+	parseFailures int32
+	cooldownUntil int64
+
+	errors  errorHistory
+	targets distinctTargets
+
+	sizeMu      sync.Mutex
+	sizeStart   time.Time
+	sizeMax     int64
+	sizePrevMax int64
+}
+
+func (s *moduleState) markSucceeded() {
+	if s != nil {
+		atomic.StoreInt64(&s.lastSuccess, clk.Now().UnixNano())
+		atomic.StoreInt32(&s.up, 1)
+		atomic.StoreInt32(&s.scraped, 1)
+		atomic.StoreInt32(&s.parseFailures, 0)
+	}
+}
+
+func (s *moduleState) markFailed() {
+	if s != nil {
+		atomic.StoreInt32(&s.up, 0)
+		atomic.StoreInt32(&s.scraped, 1)
+	}
+}
+
+func (s *moduleState) hasSucceeded() bool {
+	return s != nil && atomic.LoadInt64(&s.lastSuccess) != 0
+}
+
+// startScrape counts a scrape as in flight until the returned function is
+// called.
+func (s *moduleState) startScrape() func() {
+	if s == nil {
+		return func() {}
+	}
+	atomic.AddInt32(&s.inFlight, 1)
+	return func() { atomic.AddInt32(&s.inFlight, -1) }
+}
+
+// acquire waits for a free scrape slot of module name, until ctx is done.
+// The returned function releases the slot.
+func (s *moduleState) acquire(ctx context.Context, name string) (func(), error) {
+	if s == nil || s.slots == nil {
+		return func() {}, nil
+	}
+	st := clk.Now()
+	defer func() {
+		moduleQueueWait.WithLabelValues(name).Observe(clk.Now().Sub(st).Seconds())
+	}()
+	select {
+	case s.slots <- struct{}{}:
+		return func() { <-s.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// parseFailed records a failure of module cfg to parse the content from its
+// source. Once ParseFailureThreshold failures happened in a row, the module
+// is not tried again for ParseFailureCooldown.
+func (cfg ModuleConfig) parseFailed() {
+	moduleParseErrorCount.WithLabelValues(cfg.name).Inc()
+	s := cfg.state
+	if s == nil || cfg.ParseFailureThreshold <= 0 {
+		return
+	}
+	if atomic.AddInt32(&s.parseFailures, 1) < int32(cfg.ParseFailureThreshold) {
+		return
+	}
+	atomic.StoreInt32(&s.parseFailures, 0)
+	until := clk.Now().Add(cfg.ParseFailureCooldown)
+	atomic.StoreInt64(&s.cooldownUntil, until.UnixNano())
+	parseCooldownUntil.WithLabelValues(cfg.name).Set(float64(until.UnixNano()) / float64(time.Second))
+	log.Warnf("Module %v failed to parse %d times in a row, failing its scrapes until %v", cfg.name, cfg.ParseFailureThreshold, until)
+}
+
+// coolingDown reports whether the module is in a parse failure cooldown, and
+// until when.
+func (s *moduleState) coolingDown() (time.Time, bool) {
+	if s == nil {
+		return time.Time{}, false
+	}
+	until := atomic.LoadInt64(&s.cooldownUntil)
+	if until == 0 || clk.Now().UnixNano() >= until {
+		return time.Time{}, false
+	}
+	return time.Unix(0, until), true
+}
+
+// observeResponseSize records the size of a response of module name. The
+// largest size seen in the current and the previous window is reported in
+// expexp_module_max_response_bytes.
+func (s *moduleState) observeResponseSize(name string, window time.Duration, n int64) {
+	if s == nil {
+		return
+	}
+	s.sizeMu.Lock()
+	defer s.sizeMu.Unlock()
+	now := clk.Now()
+	if el := now.Sub(s.sizeStart); el >= window {
+		s.sizePrevMax = s.sizeMax
+		if el >= 2*window {
+			s.sizePrevMax = 0
+		}
+		s.sizeMax = 0
+		s.sizeStart = now
+	}
+	if n > s.sizeMax {
+		s.sizeMax = n
+	}
+	max := s.sizeMax
+	if s.sizePrevMax > max {
+		max = s.sizePrevMax
+	}
+	moduleMaxResponseBytes.WithLabelValues(name).Set(float64(max))
+}
+
+// statusRecorder remembers the status code and the number of body bytes
+// written to a ResponseWriter, and the start of the body of error
+// responses.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	errMsg []byte
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if s.status != http.StatusOK && len(s.errMsg) < maxErrorMessage {
+		m := p
+		if len(m) > maxErrorMessage-len(s.errMsg) {
+			m = m[:maxErrorMessage-len(s.errMsg)]
+		}
+		s.errMsg = append(s.errMsg, m...)
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	if err == errResponseTooLarge {
+		// The buffered response was replaced with an error.
+		s.status = http.StatusInternalServerError
+		s.errMsg = []byte(err.Error())
+	}
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		if s.status == 0 {
+			s.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultStreamMaxBytes = 16 << 20
+
+	// streamSnapshotEnd is the line terminating each snapshot written by
+	// the command of a stream module.
+	streamSnapshotEnd = "# EOF"
+
+	noExpiry = time.Duration(math.MaxInt64)
+)
+
+var (
+	streamRestartsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_stream_restarts_total",
+			Help: "Counts of restarts of stream module commands",
+		},
+		[]string{"module"},
+	)
+	streamOversizedCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_stream_oversized_snapshots_total",
+			Help: "Counts of stream module snapshots discarded for exceeding max_bytes",
+		},
+		[]string{"module"},
+	)
+)
+
+var (
+	streamAgeName        = "expexp_stream_snapshot_age_seconds"
+	streamAgeHelp        = "Age of the served snapshot of a stream module"
+	streamAgeLabelModule = "module"
+)
+
+// StreamConfig configures a module running a long-lived command which keeps
+// writing snapshots of its metrics in text exposition format, each ended by a
+// "# EOF" line. Scrapes are served the latest complete snapshot.
+type StreamConfig struct {
+	Command               string                 `yaml:"command"`
+	Args                  []string               `yaml:"args"`
+	Env                   map[string]string      `yaml:"env"`
+	MaxBytes              int64                  `yaml:"max_bytes"`               // 16MiB
+	MaxAge                time.Duration          `yaml:"max_age"`                 // 0, unlimited
+	RestartInitialBackoff time.Duration          `yaml:"restart_initial_backoff"` // 1s
+	RestartMaxBackoff     time.Duration          `yaml:"restart_max_backoff"`     // 1m
+	XXX                   map[string]interface{} `yaml:",inline"`
+
+	snapshot *lastResult
+	proc     *streamProc
+	mcfg     *ModuleConfig
+}
+
+// streamProc tracks the running command of a stream module. It is owned by
+// the configuration whose Run started it, or which adopted it on a reload,
+// and is only stopped when the Run of its owner ends.
+type streamProc struct {
+	sync.Mutex
+	owner  *Config
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// start runs the command of module m for cfg unless it is running already.
+func (p *streamProc) start(cfg *Config, m *ModuleConfig) {
+	p.Lock()
+	defer p.Unlock()
+	if p.owner == nil {
+		p.owner = cfg
+	}
+	if p.done != nil {
+		select {
+		case <-p.done:
+		default:
+			return
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	p.cancel, p.done = cancel, done
+	go func() {
+		defer close(done)
+		m.Stream.run(ctx, m.name)
+	}()
+}
+
+// stop stops the command if it is still owned by cfg, and waits for it to
+// exit.
+func (p *streamProc) stop(cfg *Config) {
+	p.Lock()
+	if p.owner != cfg || p.done == nil {
+		p.Unlock()
+		return
+	}
+	p.cancel()
+	done := p.done
+	p.Unlock()
+	<-done
+}
+
+// adopt makes cfg the owner of the command.
+func (p *streamProc) adopt(cfg *Config) {
+	p.Lock()
+	defer p.Unlock()
+	p.owner = cfg
+}
+
+func (c *StreamConfig) check() error {
+	if len(c.XXX) != 0 {
+		return fmt.Errorf("Unknown stream module configuration fields: %v", c.XXX)
+	}
+	if c.Command == "" {
+		return fmt.Errorf("command argument for stream module is mandatory")
+	}
+	if c.MaxBytes == 0 {
+		c.MaxBytes = defaultStreamMaxBytes
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = noExpiry
+	}
+	if c.RestartInitialBackoff == 0 {
+		c.RestartInitialBackoff = time.Second
+	}
+	if c.RestartMaxBackoff == 0 {
+		c.RestartMaxBackoff = time.Minute
+	}
+	if c.MaxBytes < 0 || c.MaxAge < 0 || c.RestartInitialBackoff < 0 || c.RestartMaxBackoff < c.RestartInitialBackoff {
+		return fmt.Errorf("stream module settings must not be negative, restart_max_backoff not below restart_initial_backoff")
+	}
+	c.snapshot = &lastResult{}
+	c.proc = &streamProc{}
+	return nil
+}
+
+// Run runs the background work of the modules of cfg, such as the commands of
+// stream modules, dropping expired cached responses and warming the modules
+// with warm_on_start, until ctx is done. It returns once everything it
+// started has stopped. Commands taken over by another configuration with
+// Adopt keep running.
+func (cfg *Config) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	if cfg.warmed != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfg.warm(ctx)
+		}()
+	}
+	expire := func(d time.Duration, f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			expireEvery(ctx, d, f)
+		}()
+	}
+	for _, m := range cfg.Modules {
+		if m.Method == "stream" {
+			m.Stream.proc.start(cfg, m)
+		}
+		if m.cache != nil {
+			expire(m.cache.maxAge, m.cache.expire)
+		}
+		if m.Method == "http" && m.HTTP.FreshnessProbe != nil {
+			expire(m.HTTP.FreshnessProbe.MaxAge, m.HTTP.FreshnessProbe.responses.expire)
+		}
+	}
+	<-ctx.Done()
+	for _, m := range cfg.Modules {
+		if m.Method == "stream" {
+			m.Stream.proc.stop(cfg)
+		}
+	}
+	wg.Wait()
+}
+
+// run keeps the command of module name running until ctx is done,
+// restarting it with a growing delay whenever it exits. The delay is reset
+// once a restarted command delivers a snapshot.
+func (c StreamConfig) run(ctx context.Context, name string) {
+	b := backoff{initial: c.RestartInitialBackoff, max: c.RestartMaxBackoff}
+	retry := 0
+	for {
+		got, err := c.runOnce(ctx, name)
+		if ctx.Err() != nil {
+			return
+		}
+		if got {
+			retry = 0
+		}
+		d := b.delay(retry)
+		retry++
+		log.Warnf("Stream module %v command exited, restarting in %v, %v", name, d, err)
+		streamRestartsCount.WithLabelValues(name).Inc()
+		if sleep(ctx, d) != nil {
+			return
+		}
+	}
+}
+
+// runOnce runs the command once, reporting whether it delivered any
+// snapshot.
+func (c StreamConfig) runOnce(ctx context.Context, name string) (bool, error) {
+	cmd := newCommand(ctx, c.Command, c.Args, c.Env)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return false, err
+	}
+
+	cmdStartsCount.WithLabelValues(name).Inc()
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+
+	got, rerr := c.readSnapshots(out, name)
+	if rerr != nil {
+		// Nobody reads the output any more, do not leave the command
+		// blocked writing it.
+		cmd.Process.Kill()
+	}
+	err = cmd.Wait()
+	if rerr != nil {
+		err = rerr
+	}
+	if err != nil {
+		cmdFailsCount.WithLabelValues(name).Inc()
+	}
+	return got, err
+}
+
+// readSnapshots reads snapshots from r until it ends, storing each one that
+// parses. At most MaxBytes of a snapshot are kept in memory, larger ones are
+// discarded.
+func (c StreamConfig) readSnapshots(r io.Reader, name string) (bool, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 4096), int(c.MaxBytes))
+
+	var buf bytes.Buffer
+	got, oversized := false, false
+	for sc.Scan() {
+		line := sc.Bytes()
+		if string(line) != streamSnapshotEnd {
+			if !oversized && int64(buf.Len()+len(line)+1) > c.MaxBytes {
+				oversized = true
+				buf.Reset()
+			}
+			if !oversized {
+				buf.Write(line)
+				buf.WriteByte('\n')
+			}
+			continue
+		}
+
+		if oversized {
+			log.Warnf("Stream module %v discarded a snapshot larger than %v bytes", name, c.MaxBytes)
+			streamOversizedCount.WithLabelValues(name).Inc()
+		} else if c.storeSnapshot(&buf, name) {
+			got = true
+		}
+		oversized = false
+		buf.Reset()
+	}
+	return got, sc.Err()
+}
+
+func (c StreamConfig) storeSnapshot(r io.Reader, name string) bool {
+	var prsr expfmt.TextParser
+	mfs, err := prsr.TextToMetricFamilies(r)
+	if err != nil {
+		log.Warnf("Stream module %v received an unparsable snapshot, %v", name, err)
+		proxyMalformedCount.WithLabelValues(name).Inc()
+		moduleParseErrorCount.WithLabelValues(name).Inc()
+		return false
+	}
+	res := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		res = append(res, mf)
+	}
+	c.snapshot.store(res)
+	return true
+}
+
+func (c StreamConfig) GatherWithContext(ctx context.Context, r *http.Request) prometheus.GathererFunc {
+	return func() ([]*dto.MetricFamily, error) {
+		mfs, age, ok := c.snapshot.load(c.MaxAge)
+		if !ok {
+			moduleReadErrorCount.WithLabelValues(c.mcfg.name).Inc()
+			return nil, fmt.Errorf("no current snapshot from the command of stream module %v", c.mcfg.name)
+		}
+		mfs, err := c.mcfg.postProcess(ctx, mfs)
+		if err != nil {
+			return nil, err
+		}
+		v := age.Seconds()
+		return append(mfs, &dto.MetricFamily{
+			Name: &streamAgeName,
+			Help: &streamAgeHelp,
+			Type: &mtimeType,
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{{Name: &streamAgeLabelModule, Value: &c.mcfg.name}},
+				Gauge: &dto.Gauge{Value: &v},
+			}},
+		}), nil
+	}
+}
+
+func (c StreamConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	g := c.GatherWithContext(ctx, r)
+	serveGatherer(w, r, recoverGatherer(c.mcfg.name, g))
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// applyTemplates merges the module templates of the configuration data into
+// the modules naming them with "template". Settings of the module override
+// those of its template, maps such as http or exec are merged key by key.
+// It returns the data with the templates section removed, or data itself
+// if there is none.
+func applyTemplates(data []byte) ([]byte, error) {
+	var raw map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	ts, ok := raw["templates"]
+	if !ok {
+		return data, nil
+	}
+	templates, ok := ts.(map[interface{}]interface{})
+	if !ok && ts != nil {
+		return nil, fmt.Errorf("templates must map template names to module settings")
+	}
+	for name, t := range templates {
+		tm, ok := t.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("template %v must be a map of module settings", name)
+		}
+		if _, ok := tm["template"]; ok {
+			return nil, fmt.Errorf("template %v can not use another template", name)
+		}
+	}
+	delete(raw, "templates")
+
+	modules, _ := raw["modules"].(map[interface{}]interface{})
+	for name, m := range modules {
+		mm, ok := m.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		tn, ok := mm["template"]
+		if !ok {
+			continue
+		}
+		t, ok := templates[tn]
+		if !ok {
+			return nil, fmt.Errorf("module %v uses unknown template %v", name, tn)
+		}
+		delete(mm, "template")
+		merged, err := mergeSettings(t, mm, "")
+		if err != nil {
+			return nil, fmt.Errorf("module %v conflicts with template %v, %w", name, tn, err)
+		}
+		modules[name] = merged
+	}
+	return yaml.Marshal(raw)
+}
+
+// mergeSettings returns the settings of over applied on top of those of
+// base. Maps are merged recursively, anything else in over replaces base.
+func mergeSettings(base, over interface{}, path string) (interface{}, error) {
+	bm, bok := base.(map[interface{}]interface{})
+	om, ook := over.(map[interface{}]interface{})
+	switch {
+	case bok && ook:
+	case bok && over != nil || ook && base != nil:
+		return nil, fmt.Errorf("%v is a map in only one of them", path)
+	case over != nil:
+		return over, nil
+	default:
+		return base, nil
+	}
+	res := make(map[interface{}]interface{}, len(bm)+len(om))
+	for k, v := range bm {
+		res[k] = v
+	}
+	for k, v := range om {
+		p := fmt.Sprint(k)
+		if path != "" {
+			p = path + "." + p
+		}
+		merged, err := mergeSettings(res[k], v, p)
+		if err != nil {
+			return nil, err
+		}
+		res[k] = merged
+	}
+	return res, nil
+}
@@ -0,0 +1,54 @@
+package expexp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTemplates(t *testing.T) {
+	cfg, err := ReadConfig(strings.NewReader(`
+templates:
+  node:
+    method: http
+    timeout: 5s
+    http:
+      port: 9100
+      headers:
+        a: "1"
+modules:
+  one:
+    template: node
+    http:
+      address: one.example.com
+      headers:
+        b: "2"
+  two:
+    template: node
+    timeout: 10s
+    http:
+      address: two.example.com
+`))
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	one, two := cfg.Modules["one"], cfg.Modules["two"]
+	if one.Method != "http" || one.HTTP.Port != 9100 || one.HTTP.Address != "one.example.com" {
+		t.Errorf("expected the template settings to be merged, got %+v", one.HTTP)
+	}
+	if one.HTTP.Headers["a"] != "1" || one.HTTP.Headers["b"] != "2" {
+		t.Errorf("expected the headers to be merged, got %v", one.HTTP.Headers)
+	}
+	if one.Timeout.Seconds() != 5 || two.Timeout.Seconds() != 10 {
+		t.Errorf("expected the module timeout to override the template, got %v and %v", one.Timeout, two.Timeout)
+	}
+
+	for _, bad := range []string{
+		"templates: {}\nmodules:\n  m:\n    template: missing\n",
+		"templates:\n  t:\n    http: {port: 1}\nmodules:\n  m:\n    template: t\n    method: http\n    http: none\n",
+		"templates:\n  t:\n    method: http\nmodules:\n  m:\n    template: t\n",
+	} {
+		if _, err := ReadConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected an error for config:\n%s", bad)
+		}
+	}
+}
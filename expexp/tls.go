@@ -0,0 +1,49 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	tlsCertExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "expexp_tls_cert_expiry_timestamp_seconds",
+			Help: "Expiry time of loaded TLS certificates, by where they are used",
+		},
+		[]string{"source"},
+	)
+)
+
+// ObserveCertificateExpiry records the expiry time of the leaf of cert in
+// expexp_tls_cert_expiry_timestamp_seconds, labelled with source.
+func ObserveCertificateExpiry(source string, cert tls.Certificate) error {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return errors.New("no certificate to observe")
+		}
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	tlsCertExpiry.WithLabelValues(source).Set(float64(leaf.NotAfter.Unix()))
+	return nil
+}
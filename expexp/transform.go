@@ -0,0 +1,119 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultPostTransformMaxBytes = 64 << 20
+
+var (
+	postTransformErrorsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "expexp_post_transform_errors_total",
+			Help: "Counts of failed post_transform commands",
+		},
+		[]string{"module"},
+	)
+
+	errPostTransformTooLarge = errors.New("post_transform output exceeds max_bytes")
+)
+
+// PostTransformConfig configures a command that rewrites the metrics of a
+// module before they are sent to the client. The command gets the metrics in
+// text exposition format on stdin and must write text exposition to stdout.
+type PostTransformConfig struct {
+	Command  string                 `yaml:"command"`
+	Args     []string               `yaml:"args"`
+	Env      map[string]string      `yaml:"env"`
+	MaxBytes int64                  `yaml:"max_bytes"` // 64MiB
+	XXX      map[string]interface{} `yaml:",inline"`
+}
+
+func (t *PostTransformConfig) check() error {
+	if len(t.XXX) != 0 {
+		return fmt.Errorf("unknown post_transform configuration fields: %v", t.XXX)
+	}
+	if t.Command == "" {
+		return errors.New("post_transform command is mandatory")
+	}
+	if t.MaxBytes == 0 {
+		t.MaxBytes = defaultPostTransformMaxBytes
+	}
+	if t.MaxBytes < 0 {
+		return errors.New("post_transform max_bytes must not be negative")
+	}
+	return nil
+}
+
+// limitedBuffer is a writer collecting at most max bytes.
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if int64(b.buf.Len()+len(p)) > b.max {
+		return 0, errPostTransformTooLarge
+	}
+	return b.buf.Write(p)
+}
+
+// apply runs the metric families through the post_transform command of
+// module name.
+func (t *PostTransformConfig) apply(ctx context.Context, name string, mfs []*dto.MetricFamily) ([]*dto.MetricFamily, error) {
+	in, err := encodeFamilies(expfmt.FmtText, mfs)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &limitedBuffer{max: t.MaxBytes}
+	cmd := newCommand(ctx, t.Command, t.Args, t.Env)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+
+	if err := runCommand(ctx, cmd); err != nil {
+		log.Warnf("Post transform for module %v failed %+v", name, err)
+		postTransformErrorsCount.WithLabelValues(name).Inc()
+		if err == context.DeadlineExceeded {
+			proxyTimeoutCount.WithLabelValues(name).Inc()
+		}
+		return nil, err
+	}
+
+	var prsr expfmt.TextParser
+	fams, err := prsr.TextToMetricFamilies(&out.buf)
+	if err != nil {
+		log.Warnf("Post transform for module %v produced unparsable output %+v", name, err)
+		postTransformErrorsCount.WithLabelValues(name).Inc()
+		return nil, err
+	}
+
+	res := make([]*dto.MetricFamily, 0, len(fams))
+	for _, mf := range fams {
+		res = append(res, mf)
+	}
+	return res, nil
+}
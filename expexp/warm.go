@@ -0,0 +1,117 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expexp
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultWarmTimeout bounds the warm up of the modules with warm_on_start
+// unless warm_timeout is set.
+const defaultWarmTimeout = time.Minute
+
+// warmModules returns the names of the modules with WarmOnStart, sorted.
+func (cfg *Config) warmModules() []string {
+	var res []string
+	for name, m := range cfg.Modules {
+		if m.WarmOnStart {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// warm runs each module with WarmOnStart once, concurrently, so that caches
+// are filled and connections established before the first real scrape. It
+// returns once all of them are done or WarmTimeout has passed, modules still
+// running then are left to finish in the background. Failures are only
+// logged.
+func (cfg *Config) warm(ctx context.Context) {
+	defer cfg.warmOnce.Do(func() { close(cfg.warmed) })
+	ctx, cancel := clk.WithTimeout(ctx, cfg.Global.WarmTimeout)
+	defer cancel()
+
+	names := cfg.warmModules()
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(m *ModuleConfig) {
+			defer wg.Done()
+			m.warm(ctx)
+		}(cfg.Modules[name])
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	st := clk.Now()
+	select {
+	case <-done:
+		log.Infof("Warmed modules %v in %v", names, clk.Now().Sub(st))
+	case <-ctx.Done():
+		log.Warnf("Gave up warming modules after %v, %v", cfg.Global.WarmTimeout, ctx.Err())
+	}
+}
+
+// warm runs the module once like a scrape with WarmHeaders, storing the
+// response in the cache of the module if it has one.
+func (m ModuleConfig) warm(ctx context.Context) {
+	defer func() {
+		// Aborted responses and panics are failures, there is no
+		// connection to abort here and nothing above this goroutine to
+		// recover them.
+		p := recover()
+		if p == nil {
+			return
+		}
+		if p == http.ErrAbortHandler {
+			log.Warnf("Warming module %v was aborted", m.name)
+			return
+		}
+		log.Errorf("Module %v panicked while warming, %v\n%s", m.name, p, debug.Stack())
+		modulePanicsCount.WithLabelValues(m.name).Inc()
+	}()
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "/?module="+url.QueryEscape(m.name), nil)
+	if err != nil {
+		log.Warnf("Warming module %v failed, %v", m.name, err)
+		return
+	}
+	for k, v := range m.WarmHeaders {
+		r.Header.Set(k, v)
+	}
+
+	resp := newBufferedResponse()
+	switch {
+	case m.MinInterval > 0:
+		m.serveThrottled(resp, r)
+	case m.cache != nil:
+		m.serveCached(resp, r)
+	default:
+		m.serve(resp, r)
+	}
+	if resp.status != http.StatusOK {
+		log.Warnf("Warming module %v failed with status %v", m.name, resp.status)
+	}
+}
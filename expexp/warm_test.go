@@ -0,0 +1,57 @@
+package expexp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWarmOnStart(t *testing.T) {
+	withFakeClock(t)
+	path := filepath.Join(t.TempDir(), "m.prom")
+	if err := os.WriteFile(path, []byte("m 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	emit := false
+	m := &ModuleConfig{
+		Method:      "file",
+		CacheTTL:    time.Minute,
+		WarmOnStart: true,
+		WarmHeaders: map[string]string{"Accept": "text/plain"},
+		File:        FileConfig{Path: path, EmitMtime: &emit},
+	}
+	if err := CheckModuleConfig("warm", m); err != nil {
+		t.Fatalf("Failed to check module config: %v", err)
+	}
+	cfg := &Config{Modules: map[string]*ModuleConfig{"warm": m}}
+	if err := cfg.Check(); err != nil {
+		t.Fatalf("Failed to check config: %v", err)
+	}
+	rd := newReadiness(cfg)
+	ready := func() int {
+		rr := httptest.NewRecorder()
+		rd.ServeHTTP(rr, httptest.NewRequest("GET", "/-/ready", nil))
+		return rr.Code
+	}
+
+	if got := ready(); got != http.StatusServiceUnavailable {
+		t.Errorf("expected not to be ready while warming, got %v", got)
+	}
+	cfg.warm(context.Background())
+	if got := ready(); got != http.StatusOK {
+		t.Errorf("expected to be ready once warmed, got %v", got)
+	}
+
+	os.Remove(path)
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/proxy?module=warm", nil)
+	r.Header.Set("Accept", "text/plain")
+	m.ServeHTTP(rr, r)
+	if rr.Code != http.StatusOK || rr.Body.String() != "# TYPE m untyped\nm 1\n" {
+		t.Errorf("expected the warmed response from the cache, got %v:\n%s", rr.Code, rr.Body.String())
+	}
+}
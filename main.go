@@ -17,24 +17,24 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"html/template"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/QubitProducts/exporter_exporter/expexp"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
@@ -46,12 +46,27 @@ var (
 	cfgDirs  StringSliceFlag
 	skipDirs = flag.Bool("config.skip-dirs", false, "Skip non existent -config.dirs entries instead of terminating.")
 
+	strictExec = flag.Bool("config.strict-exec", false, "Terminate if the command of an exec module is not found or not executable, instead of logging a warning.")
+
+	safeMode = flag.Bool("safe-mode", false, "Refuse command arguments given in requests to exec modules and drop request parameters to http modules. Terminate if shard_param is used or administrative requests are allowed.")
+
+	enableLifecycle = flag.Bool("web.enable-lifecycle", false, "Reload the configuration on POST requests to /-/reload from clients allowed administrative requests.")
+
+	waitForFiles = flag.Duration("wait-for-files", 0, "Wait up to this long at startup for the configuration, bearer token and TLS files to appear, instead of failing right away when they are missing.")
+
+	disableMtime = flag.Bool("file.disable-mtime-metric", false, "Do not add the expexp_file_mtime_timestamp metric to file modules, unless they set emit_mtime.")
+
 	addr = flag.String("web.listen-address", ":9999", "The address to listen on for HTTP requests.")
 
+	tcpKeepAlive = flag.Duration("web.tcp-keepalive", 0, "The keep-alive period of client connections, 15s if 0, disabled if negative.")
+	reusePort    = flag.Bool("web.reuse-port", false, "Set SO_REUSEPORT on the listeners, so several processes can share their ports. Linux only.")
+
 	bearerToken     = flag.String("web.bearer.token", "", "Bearer authentication token.")
 	bearerTokenFile = flag.String("web.bearer.token-file", "", "File containing the Bearer authentication token.")
 
-	acl IPNetSliceFlag
+	acl            IPNetSliceFlag
+	adminACL       IPNetSliceFlag
+	trustedProxies IPNetSliceFlag
 
 	certPath  = flag.String("web.tls.cert", "cert.pem", "Path to cert")
 	keyPath   = flag.String("web.tls.key", "key.pem", "Path to key")
@@ -65,57 +80,32 @@ var (
 
 	logLevel = LogLevelFlag(log.WarnLevel)
 	logJson  = flag.Bool("log.json", false, "Serialize log messages in JSON")
-
-	proxyDuration = prometheus.NewSummaryVec(
-		prometheus.SummaryOpts{
-			Name: "expexp_proxy_duration_seconds",
-			Help: "Duration of proxying requests to configured exporters",
-		},
-		[]string{"module"},
-	)
-	proxyErrorCount = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "expexp_proxy_errors_total",
-			Help: "Counts of errors",
-		},
-		[]string{"module"},
-	)
-	proxyTimeoutCount = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "expexp_proxy_timeout_errors_total",
-			Help: "Counts of the number of times a proxy timeout occurred",
-		},
-		[]string{"module"},
-	)
-
-	proxyMalformedCount = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "expexp_malformed_content_errors_total",
-			Help: "Counts of unparsable scrape content errors",
-		},
-		[]string{"module"},
-	)
 )
 
 func init() {
-	// register the collector metrics in the default
-	// registry.
-	prometheus.MustRegister(proxyDuration)
-	prometheus.MustRegister(proxyTimeoutCount)
-	prometheus.MustRegister(proxyErrorCount)
-	prometheus.MustRegister(proxyMalformedCount)
-	prometheus.MustRegister(cmdStartsCount)
-	prometheus.MustRegister(cmdFailsCount)
-
 	flag.Var(&cfgDirs, "config.dirs", "The path to directories of configuration files, can be specified multiple times.")
 	flag.Var(&acl, "allow.net", "Allow connection from this network specified in CIDR notation. Can be specified multiple times.")
+	flag.Var(&adminACL, "web.admin.allow-net", "Allow administrative requests, such as counting the series of a module, from this network specified in CIDR notation. Can be specified multiple times.")
+	flag.Var(&trustedProxies, "web.trusted-proxies", "Take client addresses from X-Forwarded-For and X-Real-IP headers of requests coming from this network, specified in CIDR notation. Can be specified multiple times.")
 	flag.Var(&logLevel, "log.level", "Log level")
 }
 
+// config combines the module configuration with the settings given on the
+// command line.
+type config struct {
+	*expexp.Config
+
+	bearerToken   string
+	proxyPath     string
+	telemetryPath string
+}
+
 func setup() (*config, error) {
 	cfg := &config{
-		Modules: make(map[string]*moduleConfig),
-		XXX:     make(map[string]interface{}),
+		Config: &expexp.Config{
+			Modules: make(map[string]*expexp.ModuleConfig),
+			XXX:     make(map[string]interface{}),
+		},
 	}
 	if *cfgFile != "" {
 		r, err := os.Open(*cfgFile)
@@ -124,7 +114,7 @@ func setup() (*config, error) {
 		}
 		defer r.Close()
 
-		cfg, err = readConfig(r)
+		cfg.Config, err = expexp.ReadConfig(r)
 		if err != nil {
 			return nil, err
 		}
@@ -165,7 +155,7 @@ cfgDirs:
 			}
 			defer r.Close()
 
-			mcfg, err := readModuleConfig(mn, r)
+			mcfg, err := expexp.ReadModuleConfig(mn, r)
 			if err != nil {
 				return nil, fmt.Errorf("failed reading configs %s, %w", fullpath, err)
 			}
@@ -178,6 +168,21 @@ cfgDirs:
 		log.Errorln("no modules loaded from any config file")
 	}
 
+	cfg.SetEmitMtimeDefault(!*disableMtime)
+	cfg.Admin = expexp.AdminConfig{ACL: adminACL, TrustedProxies: trustedProxies}
+	cfg.SafeMode = *safeMode
+
+	if err := cfg.Check(); err != nil {
+		return nil, err
+	}
+
+	for _, err := range cfg.CheckCommands() {
+		if *strictExec {
+			return nil, err
+		}
+		log.Warnln(err)
+	}
+
 	if *bearerToken != "" {
 		cfg.bearerToken = *bearerToken
 	}
@@ -203,9 +208,59 @@ cfgDirs:
 	if cfg.proxyPath == cfg.telemetryPath {
 		return nil, fmt.Errorf("flags -web.proxy-path and -web.telemetry-path can not be set to the same value")
 	}
+	// "/" serves the module listing, the telemetry path must stay reachable
+	// regardless of the modules configured.
+	if cfg.telemetryPath == "/" || cfg.proxyPath == "/" {
+		return nil, fmt.Errorf("flags -web.proxy-path and -web.telemetry-path can not be set to /")
+	}
 	return cfg, nil
 }
 
+// startupFiles returns the files which have to exist for the startup to
+// succeed with the flags given.
+func startupFiles() []string {
+	var files []string
+	if *cfgFile != "" {
+		files = append(files, *cfgFile)
+	}
+	if !*skipDirs {
+		files = append(files, cfgDirs...)
+	}
+	if *bearerTokenFile != "" {
+		files = append(files, *bearerTokenFile)
+	}
+	if *tlsAddr != "" {
+		files = append(files, *certPath, *keyPath)
+		if *verify {
+			files = append(files, *caPath)
+		}
+	}
+	return files
+}
+
+// awaitFiles waits up to timeout for all files to exist. Startup then goes
+// on either way, failing as usual if files are still missing.
+func awaitFiles(files []string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	logged := false
+	for {
+		var missing []string
+		for _, f := range files {
+			if _, err := os.Stat(f); err != nil {
+				missing = append(missing, f)
+			}
+		}
+		if len(missing) == 0 || !time.Now().Before(deadline) {
+			return
+		}
+		if !logged {
+			log.Warnf("Waiting up to %v for files %v", timeout, missing)
+			logged = true
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
 func getClientValidator(r *regexp.Regexp, helloInfo *tls.ClientHelloInfo) func([][]byte, [][]*x509.Certificate) error {
 	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 		for _, c := range verifiedChains {
@@ -240,6 +295,9 @@ func setupTLS() (*tls.Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Could not parse key/cert, %w", err)
 	}
+	if err := expexp.ObserveCertificateExpiry("server", cert); err != nil {
+		return nil, fmt.Errorf("Could not parse cert, %w", err)
+	}
 
 	tlsConfig = &tls.Config{
 		Certificates: []tls.Certificate{cert},
@@ -291,13 +349,16 @@ func setupTLS() (*tls.Config, error) {
 func runListener(ctx context.Context, name string, lsnr net.Listener, handler http.Handler) error {
 	srvr := http.Server{
 		Handler: handler,
+		BaseContext: func(net.Listener) context.Context {
+			return expexp.WithListener(context.Background(), name)
+		},
 	}
 	go func() {
 		<-ctx.Done()
 		srvr.Shutdown(context.Background())
 	}()
 
-	if err := srvr.Serve(lsnr); err != nil {
+	if err := srvr.Serve(lsnr); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("listener %s stopped, %w", name, err)
 	}
 	return nil
@@ -312,6 +373,11 @@ func main() {
 		}
 	}()
 
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		err = query(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 	manageService()
 
@@ -320,6 +386,8 @@ func main() {
 		return
 	}
 
+	awaitFiles(startupFiles(), *waitForFiles)
+
 	cfg, err := setup()
 	if err != nil {
 		return
@@ -336,7 +404,7 @@ func main() {
 
 	var lsnr net.Listener
 	if *addr != "" {
-		lsnr, err = net.Listen("tcp", *addr)
+		lsnr, err = listen(*addr)
 		if err != nil {
 			return
 		}
@@ -344,7 +412,7 @@ func main() {
 
 	var tlsLsnr net.Listener
 	if *tlsAddr != "" {
-		tlsLsnr, err = net.Listen("tcp", *tlsAddr)
+		tlsLsnr, err = listen(*tlsAddr)
 		if err != nil {
 			return
 		}
@@ -352,28 +420,52 @@ func main() {
 		tlsLsnr = tls.NewListener(tlsLsnr, tlsConfig)
 	}
 
-	http.HandleFunc(cfg.proxyPath, cfg.doProxy)
-	http.HandleFunc("/", cfg.listModules)
+	var listeners []string
+	if lsnr != nil {
+		listeners = append(listeners, "http")
+	}
+	if tlsLsnr != nil {
+		listeners = append(listeners, "https")
+	}
+	if err = cfg.CheckListeners(listeners); err != nil {
+		return
+	}
+
+	rl := newReloader(cfg, listeners)
+	http.Handle("/", rl)
+	http.Handle("/-/reload", &expexp.IPAddressAuthMiddleware{Handler: http.HandlerFunc(rl.serveReload), ACL: adminACL, TrustedProxies: trustedProxies})
 	http.Handle(cfg.telemetryPath, promhttp.Handler())
 
 	handler := http.Handler(http.DefaultServeMux)
 
 	if cfg.bearerToken != "" {
-		handler = &BearerAuthMiddleware{handler, cfg.bearerToken}
+		handler = &expexp.BearerAuthMiddleware{Handler: handler, Token: cfg.bearerToken}
 	}
 
 	if len(acl) > 0 {
 		log.Infof("Allowing connections only from %v", acl)
-		handler = &IPAddressAuthMiddleware{handler, acl}
+		handler = &expexp.IPAddressAuthMiddleware{Handler: handler, ACL: acl, TrustedProxies: trustedProxies}
 	}
 
 	log.SetLevel(log.Level(logLevel))
 	if *logJson {
 		log.SetFormatter(&log.JSONFormatter{})
 	}
-	handler = &AccessLogMiddleware{handler}
+	handler = &AccessLogMiddleware{handler, trustedProxies}
+	handler = &expexp.RequestCountMiddleware{Handler: handler}
 
-	eg, ctx := errgroup.WithContext(context.Background())
+	sctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	eg, ctx := errgroup.WithContext(sctx)
+
+	eg.Go(func() error {
+		rl.run(ctx)
+		return nil
+	})
+	eg.Go(func() error {
+		rl.watchSignals(ctx)
+		return nil
+	})
 
 	if lsnr != nil {
 		eg.Go(func() error {
@@ -400,8 +492,15 @@ func (w *responseWriterWithStatus) WriteHeader(status int) {
 	w.ResponseWriter.WriteHeader(status)
 }
 
+func (w *responseWriterWithStatus) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 type AccessLogMiddleware struct {
 	http.Handler
+	TrustedProxies []net.IPNet
 }
 
 func (middleware AccessLogMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -410,7 +509,12 @@ func (middleware AccessLogMiddleware) ServeHTTP(w http.ResponseWriter, r *http.R
 		statusWriter = &responseWriterWithStatus{w, http.StatusOK}
 	)
 	defer func() {
-		remoteHost, _, _ := net.SplitHostPort(r.RemoteAddr)
+		var remoteHost string
+		if addr, err := expexp.ClientIP(r, middleware.TrustedProxies); err == nil {
+			remoteHost = addr.String()
+		} else {
+			remoteHost, _, _ = net.SplitHostPort(r.RemoteAddr)
+		}
 		log.Infof(
 			"%s - %s \"%s\" %d %s (took %s)",
 			remoteHost, r.Method, r.URL.RequestURI(), statusWriter.status,
@@ -420,95 +524,6 @@ func (middleware AccessLogMiddleware) ServeHTTP(w http.ResponseWriter, r *http.R
 	middleware.Handler.ServeHTTP(statusWriter, r)
 }
 
-func (cfg *config) doProxy(w http.ResponseWriter, r *http.Request) {
-	mod, ok := r.URL.Query()["module"]
-	if !ok {
-		log.Errorf("no module given")
-		http.Error(w, fmt.Sprintf("require parameter module is missing%v\n", mod), http.StatusBadRequest)
-		return
-	}
-
-	log.Debugf("running module %v\n", mod[0])
-
-	var h http.Handler
-	if m, ok := cfg.Modules[mod[0]]; !ok {
-		proxyErrorCount.WithLabelValues("unknown").Inc()
-		log.Warnf("unknown module requested  %v\n", mod)
-		http.Error(w, fmt.Sprintf("unknown module %v\n", mod), http.StatusNotFound)
-		return
-	} else {
-		h = m
-	}
-
-	h.ServeHTTP(w, r)
-}
-
-func (cfg *config) listModules(w http.ResponseWriter, r *http.Request) {
-	switch r.Header.Get("Accept") {
-	case "application/json":
-		log.Debugf("Listing modules in json")
-		moduleJSON, err := json.Marshal(cfg.Modules)
-		if err != nil {
-			log.Error(err)
-			http.Error(w, "Failed to produce JSON", http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(moduleJSON)
-	default:
-		log.Debugf("Listing modules in html")
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		tmpl := template.Must(template.New("modules").Parse(`
-			<h2>Exporters:</h2>
-				<ul>
-					{{range $name, $cfg := .Modules}}
-						<li><a href="/proxy?module={{$name}}">{{$name}}</a></li>
-					{{end}}
-				</ul>`))
-		err := tmpl.Execute(w, cfg)
-		if err != nil {
-			log.Error(err)
-			http.Error(w, "Can't execute the template", http.StatusInternalServerError)
-		}
-	}
-	return
-}
-
-func (m moduleConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	st := time.Now()
-	defer func() {
-		proxyDuration.WithLabelValues(m.name).Observe(float64(time.Since(st)) / float64(time.Second))
-	}()
-
-	nr := r
-	cancel := func() {}
-	if m.Timeout != 0 {
-		log.Debugf("setting module %v timeout to %v", m.name, m.Timeout)
-
-		var ctx context.Context
-		ctx, cancel = context.WithTimeout(r.Context(), m.Timeout)
-		nr = r.WithContext(ctx)
-	}
-	defer cancel()
-
-	switch m.Method {
-	case "exec":
-		m.Exec.mcfg = &m
-		m.Exec.ServeHTTP(w, nr)
-	case "http":
-		m.HTTP.mcfg = &m
-		m.HTTP.ServeHTTP(w, nr)
-	case "file":
-		m.File.mcfg = &m
-		m.File.ServeHTTP(w, nr)
-	default:
-		log.Errorf("unknown module method  %v\n", m.Method)
-		proxyErrorCount.WithLabelValues(m.name).Inc()
-		http.Error(w, fmt.Sprintf("unknown module method %v\n", m.Method), http.StatusNotFound)
-		return
-	}
-}
-
 // StringSliceFlags collects multiple uses of a named flag into a slice.
 type StringSliceFlag []string
 
@@ -0,0 +1,135 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// queryWriter writes successful module responses to stdout and failed ones
+// to stderr, remembering the status.
+type queryWriter struct {
+	header http.Header
+	status int
+}
+
+func (q *queryWriter) Header() http.Header { return q.header }
+
+func (q *queryWriter) WriteHeader(status int) {
+	if q.status == 0 {
+		q.status = status
+	}
+}
+
+func (q *queryWriter) Write(p []byte) (int, error) {
+	q.WriteHeader(http.StatusOK)
+	out := io.Writer(os.Stdout)
+	if q.status != http.StatusOK {
+		out = os.Stderr
+	}
+	return out.Write(p)
+}
+
+// query implements the query subcommand: it runs one module of the
+// configuration once, like a scrape of the server would, and prints the
+// result in text format.
+func query(args []string) error {
+	module := flag.String("module", "", "The module to query.")
+	path := flag.String("path", "", "The path scraped on the upstream of an http module, instead of the configured one.")
+	target := flag.String("target", "", "The target query string parameter passed to the module.")
+	params := flag.String("params", "", "Further query string parameters passed to the module, e.g. 'target=example.com'.")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	log.SetLevel(log.Level(logLevel))
+
+	if *module == "" {
+		return fmt.Errorf("flag -module is required")
+	}
+	qvs, err := url.ParseQuery(*params)
+	if err != nil {
+		return fmt.Errorf("invalid -params, %w", err)
+	}
+	if *target != "" {
+		qvs.Set("target", *target)
+	}
+
+	cfg, err := setup()
+	if err != nil {
+		return err
+	}
+	m, ok := cfg.Modules[*module]
+	if !ok {
+		return fmt.Errorf("unknown module %v", *module)
+	}
+	// Stream modules serve the output of a command the server keeps
+	// running, there is nothing to query before it has produced some.
+	if m.Method == "stream" {
+		return fmt.Errorf("stream module %v can only be queried on a running server", *module)
+	}
+	if *path != "" {
+		if err := m.SetPath(*path); err != nil {
+			return fmt.Errorf("invalid -path, %w", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The module parameter has to come first, http modules pass the others
+	// on to the upstream.
+	rawQuery := url.Values{"module": {*module}}.Encode()
+	if len(qvs) != 0 {
+		rawQuery += "&" + qvs.Encode()
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.proxyPath+"?"+rawQuery, nil)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Accept", "text/plain")
+
+	w := &queryWriter{header: http.Header{}}
+	if err := serveQuery(m, w, r); err != nil {
+		return err
+	}
+	if w.status != http.StatusOK {
+		return fmt.Errorf("module %v failed with status %d", *module, w.status)
+	}
+	return nil
+}
+
+// serveQuery runs h like net/http would, turning an aborted response into an
+// error. The output written before the abort is truncated.
+func serveQuery(h http.Handler, w http.ResponseWriter, r *http.Request) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				panic(p)
+			}
+			err = fmt.Errorf("module %v aborted the response, the output is truncated", r.URL.Query().Get("module"))
+		}
+	}()
+	h.ServeHTTP(w, r)
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2016 Qubit Ltd.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/QubitProducts/exporter_exporter/expexp"
+	log "github.com/sirupsen/logrus"
+)
+
+// reloader serves the modules of the current configuration, replacing it
+// with a freshly read one on SIGHUP or POST /-/reload. A configuration that
+// fails to load leaves the current one in place.
+type reloader struct {
+	listeners []string
+
+	mu        sync.Mutex
+	cfg       *config
+	cancelRun context.CancelFunc
+	handler   atomic.Value // http.Handler
+}
+
+func newReloader(cfg *config, listeners []string) *reloader {
+	rl := &reloader{listeners: listeners, cfg: cfg}
+	rl.handler.Store(expexp.NewHandler(cfg.Config, cfg.proxyPath))
+	return rl
+}
+
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rl.handler.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+// reload reads the configuration again and switches to it if it is valid.
+// Settings given on the command line, such as the bearer token and the
+// proxy path, stay as they were at startup. Readiness and the state of
+// unchanged modules are carried over. If the configuration is invalid, the
+// current one stays in use but is reported as not ready.
+func (rl *reloader) reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	cfg, err := setup()
+	if err != nil {
+		rl.cfg.ReloadFailed(err)
+		return err
+	}
+	if err := cfg.CheckListeners(rl.listeners); err != nil {
+		rl.cfg.ReloadFailed(err)
+		return err
+	}
+	cfg.proxyPath = rl.cfg.proxyPath
+	cfg.Adopt(rl.cfg.Config)
+	rl.handler.Store(expexp.NewHandler(cfg.Config, cfg.proxyPath))
+	rl.cfg = cfg
+	if rl.cancelRun != nil {
+		rl.cancelRun()
+	}
+	log.Infof("Reloaded the configuration, %d modules", len(cfg.Modules))
+	return nil
+}
+
+// run runs the background work of the current configuration until ctx is
+// done, restarting it whenever the configuration is reloaded.
+func (rl *reloader) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		rl.mu.Lock()
+		cfg := rl.cfg
+		rctx, cancel := context.WithCancel(ctx)
+		rl.cancelRun = cancel
+		rl.mu.Unlock()
+
+		cfg.Run(rctx)
+		<-rctx.Done()
+		cancel()
+	}
+}
+
+// watchSignals reloads the configuration on each SIGHUP until ctx is done.
+func (rl *reloader) watchSignals(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			if err := rl.reload(); err != nil {
+				log.Errorf("Failed to reload the configuration, keeping the current one, %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serveReload handles POST /-/reload, which is only enabled with
+// -web.enable-lifecycle.
+func (rl *reloader) serveReload(w http.ResponseWriter, r *http.Request) {
+	if !*enableLifecycle {
+		http.Error(w, "Lifecycle API is not enabled.", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := rl.reload(); err != nil {
+		log.Errorf("Failed to reload the configuration, keeping the current one, %v", err)
+		http.Error(w, fmt.Sprintf("Failed to reload the configuration: %v", err), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "Configuration reloaded")
+}
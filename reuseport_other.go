@@ -0,0 +1,14 @@
+// SO_REUSEPORT is only supported on Linux
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("-web.reuse-port is only supported on Linux")
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"runtime"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -24,11 +25,19 @@ var (
 		},
 		[]string{"version", "revision", "branch", "goversion"},
 	)
+	startTime = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "expexp_start_time_seconds",
+			Help: "Time exporter_exporter was started, in seconds since the epoch.",
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(buildInfo)
 	buildInfo.WithLabelValues(Version, Revision, Branch, GoVersion).Set(1)
+	prometheus.MustRegister(startTime)
+	startTime.Set(float64(time.Now().UnixNano()) / 1e9)
 }
 
 func versionStr() string {